@@ -0,0 +1,37 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+import (
+	"io"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// ofdUnsupported is set once the kernel turns out not to support OFD locks.
+var ofdUnsupported int32
+
+// ofdLocks is OFDLocks, as the OFD backend is implemented here.
+const ofdLocks = OFDLocks
+
+// ofdLock applies a flock style operation to the whole of the file open as fd
+// using an OFD lock, reporting false if the kernel doesn't support them.
+func ofdLock(fd, how int) (bool, error) {
+	if atomic.LoadInt32(&ofdUnsupported) != 0 {
+		return false, nil
+	}
+	lk := unix.Flock_t{Whence: io.SeekStart, Type: recordLockType(how)}
+	cmd := unix.F_OFD_SETLKW
+	if how&lockNb != 0 {
+		cmd = unix.F_OFD_SETLK
+	}
+	err := unix.FcntlFlock(uintptr(fd), cmd, &lk)
+	if err == unix.EINVAL {
+		// Kernels before 3.15 don't know these commands.
+		atomic.StoreInt32(&ofdUnsupported, 1)
+		return false, nil
+	}
+	return true, lockError(err)
+}
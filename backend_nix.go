@@ -0,0 +1,81 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package fslock
+
+import (
+	"io"
+	"syscall"
+)
+
+// lockFd applies a flock style operation to the whole of the file open as
+// fd using the given backend.  Whatever the backend, how is given and errors
+// are returned as for flock, with contention always reported as EWOULDBLOCK.
+// Every whole file lock goes through it, so tests replace it to simulate
+// contention and failures.
+var lockFd = sysLockFd
+
+// sysLockFd is the real lockFd.  An operation interrupted by a signal, as a
+// blocking one can be at any time in a Go program, is tried again rather than
+// failing with EINTR.
+func sysLockFd(backend Backend, fd, how int) error {
+	for {
+		if err := applyLock(backend, fd, how); err != syscall.EINTR {
+			return err
+		}
+	}
+}
+
+// applyLock makes a single attempt at the operation for sysLockFd.  It is a
+// variable so that tests can interrupt it.
+var applyLock = sysApplyLock
+
+// sysApplyLock is the real applyLock.
+func sysApplyLock(backend Backend, fd, how int) error {
+	switch backend {
+	case OFD:
+		if ok, err := ofdLock(fd, how); ok {
+			return err
+		}
+	case Fcntl:
+		return fcntlFlock(fd, how)
+	}
+	return lockError(sysFlock(fd, how))
+}
+
+// fcntlFlock applies a flock style operation to the whole of the file open
+// as fd using a classic record lock.
+func fcntlFlock(fd, how int) error {
+	lk := syscall.Flock_t{Whence: io.SeekStart, Type: recordLockType(how)}
+	cmd := syscall.F_SETLKW
+	if how&lockNb != 0 {
+		cmd = syscall.F_SETLK
+	}
+	return lockError(syscall.FcntlFlock(uintptr(fd), cmd, &lk))
+}
+
+// recordLockType returns the type of record lock equivalent to the flock
+// operation how.
+func recordLockType(how int) int16 {
+	switch how &^ lockNb {
+	case lockEx:
+		return syscall.F_WRLCK
+	case lockSh:
+		return syscall.F_RDLCK
+	}
+	return syscall.F_UNLCK
+}
+
+// lockError returns EWOULDBLOCK for any of the errors that systems give for a
+// non-blocking lock that is held by someone else: EAGAIN, which is
+// EWOULDBLOCK on most systems, and EACCES, which POSIX allows fcntl to give
+// instead and some systems do.  Other errors are returned as they are.
+func lockError(err error) error {
+	if err == syscall.EAGAIN || err == syscall.EACCES {
+		return syscall.EWOULDBLOCK
+	}
+	return err
+}
@@ -0,0 +1,15 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build aix || darwin || dragonfly || freebsd || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd netbsd openbsd solaris
+
+package fslock
+
+// ofdLocks is empty, as OFD locks are Linux only.
+const ofdLocks Feature = 0
+
+// ofdLock reports that OFD locks are unsupported, as they are Linux only.
+func ofdLock(fd, how int) (bool, error) {
+	return false, nil
+}
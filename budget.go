@@ -0,0 +1,39 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+import (
+	"time"
+)
+
+// Budget is an overall time allowed for taking a number of locks, to be
+// shared between them rather than giving each the whole of it.
+type Budget struct {
+	deadline time.Time
+}
+
+// NewBudget returns a budget of timeout, starting now.
+func NewBudget(timeout time.Duration) *Budget {
+	return &Budget{deadline: time.Now().Add(timeout)}
+}
+
+// Remaining returns how much of the budget is left, or zero once it is used
+// up.
+func (b *Budget) Remaining() time.Duration {
+	remaining := time.Until(b.deadline)
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+// Lock locks l with LockWithTimeout, giving it whatever is left of the
+// budget, and returns ErrTimeout without trying if there is nothing left.
+func (b *Budget) Lock(l Locker) error {
+	remaining := b.Remaining()
+	if remaining <= 0 {
+		return ErrTimeout
+	}
+	return l.LockWithTimeout(remaining)
+}
@@ -0,0 +1,17 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build go1.20
+// +build go1.20
+
+package fslock
+
+import (
+	"context"
+)
+
+// contextError returns why ctx is done: the cause it was canceled with, if
+// any, and otherwise its error.
+func contextError(ctx context.Context) error {
+	return context.Cause(ctx)
+}
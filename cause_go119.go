@@ -0,0 +1,17 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build !go1.20
+// +build !go1.20
+
+package fslock
+
+import (
+	"context"
+)
+
+// contextError returns why ctx is done.  Contexts can't carry a cause before
+// Go 1.20, so that is just its error.
+func contextError(ctx context.Context) error {
+	return ctx.Err()
+}
@@ -0,0 +1,45 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build go1.20
+// +build go1.20
+
+package fslock_test
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/xianic/fslock"
+)
+
+func (s *fslockSuite) TestLockWithContextCause(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "lockfile")
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+	defer holder.Unlock()
+
+	cause := errors.New("shutting down")
+	lock := fslock.New(path)
+	for _, lockWith := range []func(context.Context) error{
+		lock.LockWithContext,
+		func(ctx context.Context) error {
+			return lock.LockPoll(ctx, time.Millisecond)
+		},
+		func(ctx context.Context) error {
+			return lock.LockWithRetry(ctx, time.Millisecond, shortWait)
+		},
+	} {
+		ctx, cancel := context.WithCancelCause(context.Background())
+		go func() {
+			time.Sleep(shortWait)
+			cancel(cause)
+		}()
+		c.Assert(lockWith(ctx), gc.Equals, cause)
+		c.Assert(lock.Held(), gc.Equals, false)
+	}
+}
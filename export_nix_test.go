@@ -0,0 +1,55 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package fslock
+
+import (
+	"syscall"
+)
+
+// LockError is exported for testing how lock errors are normalized.
+var LockError = lockError
+
+// The flock operations, for telling what a replacement lockFd is asked to do.
+const (
+	LockEx = lockEx
+	LockSh = lockSh
+	LockNb = lockNb
+	LockUn = lockUn
+)
+
+// SetLockFd replaces the function every whole file lock goes through with f,
+// which is passed the real one to call, and returns a function that restores
+// the real one.
+func SetLockFd(f func(real func(backend Backend, fd, how int) error, backend Backend, fd, how int) error) (restore func()) {
+	lockFd = func(backend Backend, fd, how int) error {
+		return f(sysLockFd, backend, fd, how)
+	}
+	return func() {
+		lockFd = sysLockFd
+	}
+}
+
+// SetApplyLock replaces the single attempt sysLockFd retries while it is
+// interrupted with f, which is passed the real one to call, and returns a
+// function that restores the real one.
+func SetApplyLock(f func(real func(backend Backend, fd, how int) error, backend Backend, fd, how int) error) (restore func()) {
+	applyLock = func(backend Backend, fd, how int) error {
+		return f(sysApplyLock, backend, fd, how)
+	}
+	return func() {
+		applyLock = sysApplyLock
+	}
+}
+
+// SetOpen replaces the function the lock file is opened with by f, and
+// returns a function that restores the real one.
+func SetOpen(f func(path string, mode int, perm uint32) (int, error)) (restore func()) {
+	sysOpen = f
+	return func() {
+		sysOpen = syscall.Open
+	}
+}
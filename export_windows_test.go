@@ -0,0 +1,31 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// Wait is exported for testing how each WaitForSingleObject result is handled.
+var Wait = wait
+
+// CycleOverlapped takes a structure from newOverlapped and hands it back to
+// doneOverlapped, as each request the lock makes does.
+func CycleOverlapped(l *Lock) error {
+	ol, err := l.newOverlapped()
+	if err != nil {
+		return err
+	}
+	l.doneOverlapped(ol)
+	return nil
+}
+
+// SetWaitForSingleObject replaces the WaitForSingleObject that Wait calls with
+// f, and returns a function that restores the real one.
+func SetWaitForSingleObject(f func(handle windows.Handle, milliseconds uint32) (uint32, error)) (restore func()) {
+	waitForSingleObject = f
+	return func() {
+		waitForSingleObject = windows.WaitForSingleObject
+	}
+}
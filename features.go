@@ -0,0 +1,47 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+// Feature is a set of the capabilities this package has on the current
+// platform, as reported by Features.
+type Feature uint
+
+const (
+	// Locking is set where files can be locked at all.  Without it, every
+	// locking operation returns ErrUnsupported.
+	Locking Feature = 1 << iota
+
+	// SharedLocks is set where RLock, TryRLock, Upgrade and Downgrade work.
+	SharedLocks
+
+	// RangeLocks is set where LockRange, TryLockRange and UnlockRange work.
+	RangeLocks
+
+	// ContextCancel is set where LockWithContext, LockWithTimeout and
+	// LockWithDeadline give up waiting when they are meant to.
+	ContextCancel
+
+	// PIDRecords is set where LockWithPID, HolderPID, WhoHolds and
+	// BreakStaleLock work.
+	PIDRecords
+
+	// DirLocks is set where locks from NewDir can be held exclusively.
+	DirLocks
+
+	// OFDLocks is set where the OFD backend is implemented, though it falls
+	// back to Flock on kernels that lack OFD locks.
+	OFDLocks
+
+	// MandatoryLocks is set where locks are enforced by the system, so that
+	// WithMandatory works.
+	MandatoryLocks
+)
+
+// Features returns the capabilities this package has on the current
+// platform, so that portable code can choose what to do without checking
+// runtime.GOOS itself.  It has no side effects, and doesn't probe the kernel
+// or any filesystem.
+func Features() Feature {
+	return features
+}
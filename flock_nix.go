@@ -0,0 +1,31 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package fslock
+
+import (
+	"syscall"
+)
+
+// The flock operations, named so that platforms without flock can define
+// their own.
+const (
+	lockEx = syscall.LOCK_EX
+	lockSh = syscall.LOCK_SH
+	lockNb = syscall.LOCK_NB
+	lockUn = syscall.LOCK_UN
+)
+
+// flockIsFcntl reports whether sysFlock uses fcntl record locks.
+const flockIsFcntl = false
+
+// dirLocks is DirLocks, as flock can lock directories exclusively.
+const dirLocks = DirLocks
+
+// sysFlock applies the flock operation how to the file open as fd.
+func sysFlock(fd, how int) error {
+	return syscall.Flock(fd, how)
+}
@@ -3,9 +3,39 @@
 
 // Package fslock provides a cross-process mutex based on file locks.
 //
-// It is built on top of flock for linux and darwin, and LockFileEx on Windows.
+// It is built on top of flock for linux and darwin, fcntl for Solaris,
+// illumos and AIX, LockFileEx on Windows, and exclusive-use files on Plan 9.
+//
+// Errors from the platform are wrapped with what was being done to which lock
+// file, so use errors.Is and errors.As to examine them.  The package's own
+// errors, such as ErrLocked and ErrTimeout, and context errors are returned as
+// they are.
 package fslock
 
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"time"
+)
+
+// Locker is the set of locking methods provided by Lock, so that code using
+// a lock can be given a different implementation, for instance in tests.
+type Locker interface {
+	Lock() error
+	TryLock() error
+	Unlock() error
+
+	// LockWithTimeout tries to lock until the timeout expires, returning
+	// ErrTimeout if it does.  A zero timeout tries just once, and a
+	// negative one waits for as long as it takes.
+	LockWithTimeout(timeout time.Duration) error
+}
+
+var _ Locker = (*Lock)(nil)
+
 // ErrTimeout indicates that the lock attempt timed out.
 var ErrTimeout error = timeoutError("lock timeout exceeded")
 
@@ -30,3 +60,506 @@ func (t trylockError) Error() string {
 func (trylockError) Temporary() bool {
 	return true
 }
+
+// ErrUnsupported indicates that the operation isn't supported on the current
+// platform.  On platforms without file locking, such as js/wasm, every
+// locking operation returns it.
+var ErrUnsupported error = unsupportedError("fslock operation not supported on this platform")
+
+type unsupportedError string
+
+func (u unsupportedError) Error() string {
+	return string(u)
+}
+
+// ErrAlreadyHeld indicates that the lock is already held by the instance
+// being locked, which is a mistake unless it was made with WithReentrant.
+var ErrAlreadyHeld error = alreadyHeldError("fslock is already held by this instance")
+
+type alreadyHeldError string
+
+func (a alreadyHeldError) Error() string {
+	return string(a)
+}
+
+// ErrExists indicates that CreateLock found the lock file already there, so
+// the lock is taken, or was by a holder that never removed the file.
+var ErrExists error = existsError("lock file already exists")
+
+type existsError string
+
+func (e existsError) Error() string {
+	return string(e)
+}
+
+// ErrStale indicates that the lock file was replaced, as by renaming another
+// file over it, while it was being locked, so the file that got locked is no
+// longer the lock file.  It is only returned with WithStaleCheck, in which case
+// trying again locks the new file, and by Lease.Close once BreakExpiredLease
+// has broken the lease.
+var ErrStale error = staleError("lock file was replaced while locking it")
+
+type staleError string
+
+func (s staleError) Error() string {
+	return string(s)
+}
+
+func (staleError) Temporary() bool {
+	return true
+}
+
+// ErrNotRegularFile indicates that the lock file is a directory, which can't
+// be locked like a regular file; use NewDir for that.
+var ErrNotRegularFile error = notRegularError("lock file is not a regular file")
+
+type notRegularError string
+
+func (n notRegularError) Error() string {
+	return string(n)
+}
+
+// ErrNotHeld indicates that Unlock was called on an instance that doesn't
+// hold the lock.  It is only returned with WithStrictUnlock; by default such
+// an Unlock does nothing and returns nil.
+var ErrNotHeld error = notHeldError("fslock is not held by this instance")
+
+type notHeldError string
+
+func (n notHeldError) Error() string {
+	return string(n)
+}
+
+// ErrMandatoryUnsupported indicates that WithMandatory asked for a lock that
+// the system enforces, which this platform can't provide.
+var ErrMandatoryUnsupported error = mandatoryError("mandatory locking not supported on this platform")
+
+type mandatoryError string
+
+func (m mandatoryError) Error() string {
+	return string(m)
+}
+
+// ErrInvalidPath indicates that NewChecked was given a lock path that can't
+// name a lock file.
+var ErrInvalidPath error = invalidPathError("invalid lock path")
+
+type invalidPathError string
+
+func (i invalidPathError) Error() string {
+	return string(i)
+}
+
+// ErrNotExist indicates that the lock file doesn't exist and WithNoCreate
+// stopped it being created.  errors.Is also reports it as os.ErrNotExist.
+var ErrNotExist error = notExistError("lock file does not exist")
+
+type notExistError string
+
+func (n notExistError) Error() string {
+	return string(n)
+}
+
+func (notExistError) Is(target error) bool {
+	return target == os.ErrNotExist
+}
+
+// NewChecked is like New, but checks the lock path up front, so that a
+// misconfigured path is reported when the lock is made rather than by the
+// first attempt to lock it.  It returns ErrInvalidPath if filename is empty,
+// and, unless WithMkdirAll is given to create it, an error if the directory
+// the lock file goes in doesn't exist or isn't a directory.  The lock file
+// itself needn't exist.
+func NewChecked(filename string, opts ...Option) (*Lock, error) {
+	if filename == "" {
+		return nil, ErrInvalidPath
+	}
+	l := New(filename, opts...)
+	if l.opts.mkdirAll {
+		return l, nil
+	}
+	fi, err := os.Stat(filepath.Dir(filename))
+	if err != nil {
+		return nil, l.pathError("stat directory of", err)
+	}
+	if !fi.IsDir() {
+		return nil, l.pathError("stat directory of", ErrInvalidPath)
+	}
+	return l, nil
+}
+
+// NewWithContext returns a new lock around the given file, configured by any
+// options given, whose waits for the lock are bounded by ctx, for locks that
+// shouldn't outlive the request they were made for.  Lock then behaves like
+// LockWithContext(ctx), and LockWithTimeout and LockWithDeadline give up when
+// ctx is done as well as when their own time runs out, returning the context's
+// error, or the cause it was canceled with, if any.  A context passed to
+// LockWithContext or the polling methods is used instead of ctx.
+func NewWithContext(ctx context.Context, filename string, opts ...Option) *Lock {
+	return New(filename, append(opts, func(o *options) {
+		o.ctx = ctx
+	})...)
+}
+
+// Held reports whether this instance currently holds the lock, that is
+// whether it has been successfully locked and not unlocked since.  It says
+// nothing about other instances or processes; see IsLocked for that.
+func (l *Lock) Held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.held
+}
+
+// Path returns the name of the file the lock is around, as given to New.  For
+// a directory lock on Windows or Plan 9, that is the lock file NewDir uses in
+// the directory.
+func (l *Lock) Path() string {
+	return l.filename
+}
+
+// Clone returns a new, unlocked lock around the same file, configured with
+// the same options, including whether it is a directory lock.  The clone opens
+// the file for itself, so it takes the lock independently of this instance,
+// even one made by NewFromFd or NewFromHandle, and contends with it as any
+// other instance would.
+func (l *Lock) Clone() *Lock {
+	return New(l.filename, func(o *options) {
+		*o = l.opts
+	})
+}
+
+// Exists reports whether the lock file exists, without creating it.  The
+// file is created the first time the lock is acquired, and left behind when
+// it is unlocked, so this says nothing about whether the lock is held; see
+// IsLocked for that.
+func (l *Lock) Exists() (bool, error) {
+	_, err := os.Stat(l.filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// HeldFor returns how long this instance has held the lock, or zero if it
+// doesn't hold it.  It uses the monotonic clock, so changes to the system
+// time don't affect it.
+func (l *Lock) HeldFor() time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.held {
+		return 0
+	}
+	return time.Since(l.heldSince)
+}
+
+// LockStats are the counters that Stats reports for an instance.
+type LockStats struct {
+	// Acquires is how many times the instance acquired the lock,
+	// exclusively or shared, not counting reentrant acquisitions.
+	Acquires int64
+	// Contended is how many attempts to acquire the lock found it held by
+	// someone else, whether they went on to wait for it or gave up.
+	Contended int64
+	// TotalWait and MaxWait are the total and longest time an acquisition
+	// took, from when the attempt began to when the lock was acquired.
+	TotalWait time.Duration
+	MaxWait   time.Duration
+}
+
+// Stats returns how often this instance has acquired the lock, how often it
+// found it held by someone else, and how long it waited for it, over its
+// lifetime, such as for logging which locks are hot at shutdown.  It can be
+// called at any time from any goroutine.
+func (l *Lock) Stats() LockStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.stats
+}
+
+// contended counts an attempt to acquire the lock that found it held.
+func (l *Lock) contended() {
+	l.mu.Lock()
+	l.stats.Contended++
+	l.mu.Unlock()
+}
+
+// Touch sets the lock file's modification time to now while this instance
+// holds the lock, as a heartbeat for schemes that judge whether a lock is
+// still in use by how recently its file was modified.  It does nothing if the
+// lock isn't held, and can be called from another goroutine, such as one
+// touching the file periodically until the lock is released.  Only the
+// modification and access times are changed, not the file's content.
+func (l *Lock) Touch() error {
+	if !l.Held() {
+		return nil
+	}
+	return l.pathError("touch", l.touch(time.Now()))
+}
+
+// String returns a description of the lock for use in log messages, such as
+// "fslock(/var/run/app.lock, held=true)".
+func (l *Lock) String() string {
+	if l.Held() {
+		return "fslock(" + l.filename + ", held=true)"
+	}
+	return "fslock(" + l.filename + ", held=false)"
+}
+
+// logf passes a diagnostic message about the lock to the logger given by
+// WithLogger, if any.  Without one this costs next to nothing, provided the
+// arguments are cheap to box, so prefer constants.
+func (l *Lock) logf(format string, args ...interface{}) {
+	if l.opts.logger == nil {
+		return
+	}
+	l.opts.logger("fslock: %s: "+format, append([]interface{}{l.filename}, args...)...)
+}
+
+// event passes a lock event to the slog logger given by WithSlog, if any,
+// with the lock file's path and any other attributes given as alternating
+// keys and values.  Debug events are for the steps along the way.
+func (l *Lock) event(debug bool, msg string, args ...interface{}) {
+	if l.opts.events == nil {
+		return
+	}
+	l.opts.events(debug, msg, append([]interface{}{"path", l.filename}, args...)...)
+}
+
+// timedOut reports an attempt to lock that began at start giving up, and
+// returns ErrTimeout.
+func (l *Lock) timedOut(start time.Time) error {
+	l.event(false, "lock timed out", "waited", time.Since(start), "outcome", "timeout")
+	return ErrTimeout
+}
+
+// LockWithTimeout tries to lock the lock until the timeout expires.  If the
+// timeout expires, this method will return ErrTimeout.  A zero timeout tries
+// just once, like TryLock, and a negative one waits for as long as it takes.
+// The timeout given always applies, rather than any set by
+// WithDefaultTimeout.
+func (l *Lock) LockWithTimeout(timeout time.Duration) error {
+	switch {
+	case timeout < 0:
+		// Not Lock, which may have a default timeout.
+		return l.LockWithContext(l.context())
+	case timeout == 0:
+		start := time.Now()
+		err := l.TryLock()
+		if err == ErrLocked {
+			return l.timedOut(start)
+		}
+		return err
+	}
+	return l.lockUntil(time.Now().Add(timeout))
+}
+
+// LockWithDeadline tries to lock the lock until the deadline passes.  If the
+// deadline passes, or has already passed, this method will return ErrTimeout.
+func (l *Lock) LockWithDeadline(deadline time.Time) error {
+	if now := time.Now(); !now.Before(deadline) {
+		return l.timedOut(now)
+	}
+	return l.lockUntil(deadline)
+}
+
+// lockUntil does the work of LockWithTimeout and LockWithDeadline.
+func (l *Lock) lockUntil(deadline time.Time) error {
+	start := time.Now()
+	ctx, cancel := context.WithDeadline(l.context(), deadline)
+	defer cancel()
+	err := l.LockWithContext(ctx)
+	if err == context.DeadlineExceeded {
+		return l.timedOut(start)
+	}
+	return err
+}
+
+// context returns the context given to NewWithContext, or the background
+// context if there was none.
+func (l *Lock) context() context.Context {
+	if l.opts.ctx == nil {
+		return context.Background()
+	}
+	return l.opts.ctx
+}
+
+// disown marks the lock as no longer held by this instance, without releasing
+// it, once the lock file has been handed over to the caller.
+func (l *Lock) disown() {
+	l.mu.Lock()
+	l.held = false
+	l.depth = 0
+	l.mu.Unlock()
+	if l.opts.finalizer {
+		runtime.SetFinalizer(l, nil)
+	}
+	l.logf("handed over")
+}
+
+// finalize unlocks a lock that was garbage collected while held, so that the
+// program's mistake doesn't keep the lock from everyone else until it exits.
+func (l *Lock) finalize() {
+	l.logf("garbage collected while held, unlocking")
+	l.mu.Lock()
+	l.depth = 0
+	l.mu.Unlock()
+	l.Unlock()
+}
+
+// mkdirAll creates the lock file's parent directories, if WithMkdirAll asked
+// for that.
+func (l *Lock) mkdirAll() error {
+	if !l.opts.mkdirAll {
+		return nil
+	}
+	return os.MkdirAll(filepath.Dir(l.filename), l.opts.mkdirPerm)
+}
+
+// LockDirectory locks the given directory, which must exist, blocking until
+// it is available, and returns the lock, for tools that allow only one
+// operation at a time in a directory.  On Unix the directory itself is
+// opened and locked, tying the lock to the directory rather than to anything
+// in it; elsewhere a hidden lock file inside it is locked instead.  See
+// NewDir, which it is a shorthand for.
+func LockDirectory(dir string) (*Lock, error) {
+	l := NewDir(dir)
+	if err := l.Lock(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// dirLockFile is the name of the lock file that NewDir uses in the directory
+// on platforms that can't lock directories.
+const dirLockFile = ".lock"
+
+// nested reports whether this is a reentrant lock held more than once, so
+// that unlocking it only undoes a reentrant acquisition.
+func (l *Lock) nested() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.depth > 0
+}
+
+// pathError wraps err, which came from doing op to the lock file, with op
+// and the file's name.  errors.Is and errors.As see through it to err, such
+// as a syscall.Errno.  A nil err is returned as is.
+func (l *Lock) pathError(op string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return fmt.Errorf("fslock: %s %q: %w", op, l.filename, err)
+}
+
+// startWait calls the OnWaitStart hook, if any, and reports the event to
+// WithSlog's logger as an attempt to acquire the lock begins, and returns the
+// time it began for passing to acquired.
+func (l *Lock) startWait() time.Time {
+	hooks := l.opts.hooks
+	if hooks != nil && hooks.OnWaitStart != nil {
+		hooks.OnWaitStart()
+	}
+	l.event(true, "acquiring lock")
+	return time.Now()
+}
+
+// acquired marks the lock as held, by an attempt that began at start, counts
+// it in the stats, and calls the OnAcquired hook, if any, and reports the
+// event.
+func (l *Lock) acquired(start time.Time) {
+	hooks := l.opts.hooks
+	now := time.Now()
+	waited := now.Sub(start)
+	l.mu.Lock()
+	wasHeld := l.held
+	l.held = true
+	l.heldSince = now
+	l.stats.Acquires++
+	l.stats.TotalWait += waited
+	if waited > l.stats.MaxWait {
+		l.stats.MaxWait = waited
+	}
+	l.mu.Unlock()
+	if !wasHeld && l.opts.finalizer {
+		runtime.SetFinalizer(l, (*Lock).finalize)
+	}
+	l.logf("acquired")
+	l.event(false, "lock acquired", "waited", waited, "outcome", "acquired")
+	if hooks != nil && hooks.OnAcquired != nil {
+		hooks.OnAcquired(waited)
+	}
+}
+
+// released marks the lock as not held and, if it was, calls the OnReleased
+// hook, if any, and reports the event.
+func (l *Lock) released() {
+	l.mu.Lock()
+	held, since := l.held, l.heldSince
+	l.held = false
+	if held {
+		l.releasedAt = time.Now()
+	}
+	l.mu.Unlock()
+	if !held {
+		return
+	}
+	if l.opts.finalizer {
+		runtime.SetFinalizer(l, nil)
+	}
+	l.logf("released")
+	heldFor := time.Since(since)
+	l.event(false, "lock released", "held", heldFor, "outcome", "released")
+	if hooks := l.opts.hooks; hooks != nil && hooks.OnReleased != nil {
+		hooks.OnReleased(heldFor)
+	}
+}
+
+// advisoryOnly returns ErrMandatoryUnsupported if WithMandatory was given, for
+// platforms whose locks are only advisory to refuse to lock.
+func (l *Lock) advisoryOnly() error {
+	if l.opts.mandatory {
+		return ErrMandatoryUnsupported
+	}
+	return nil
+}
+
+// unlockNotHeld returns ErrNotHeld if WithStrictUnlock was given and this
+// instance doesn't hold the lock, for Unlock to return once it has closed
+// anything left open.
+func (l *Lock) unlockNotHeld() error {
+	if l.opts.strictUnlock && !l.Held() {
+		return ErrNotHeld
+	}
+	return nil
+}
+
+// reenter reports whether this instance already holds the lock, in which
+// case a reentrant lock is now held once more, and locking any other fails
+// with ErrAlreadyHeld.
+func (l *Lock) reenter() (bool, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.held {
+		return false, nil
+	}
+	if !l.opts.reentrant {
+		return true, ErrAlreadyHeld
+	}
+	l.depth++
+	return true, nil
+}
+
+// leave reports whether unlocking only needs to undo a reentrant acquisition,
+// which it then does, rather than actually releasing the lock.
+func (l *Lock) leave() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.depth == 0 {
+		return false
+	}
+	l.depth--
+	return true
+}
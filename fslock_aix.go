@@ -0,0 +1,33 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+// AIX has no flock, so as on Solaris the Flock backend is built on fcntl
+// record locks, making it match the Fcntl backend.  Record locks belong to
+// the process rather than the open file, so instances in the same process
+// don't exclude each other, and closing any descriptor the process has for
+// the file releases them; use only one instance per lock file in a process.
+// As there, an instance never opens the file a second time while it holds the
+// lock, so looking up the holder doesn't release it.
+
+// The flock operations, which syscall doesn't define here.
+const (
+	lockSh = 1 << iota
+	lockEx
+	lockNb
+	lockUn
+)
+
+// flockIsFcntl reports whether sysFlock uses fcntl record locks.
+const flockIsFcntl = true
+
+// dirLocks is empty, as fcntl can only lock a file exclusively through a
+// descriptor open for writing, which directories can't be.
+const dirLocks Feature = 0
+
+// sysFlock applies the flock operation how to the file open as fd, using a
+// record lock over the whole file.
+func sysFlock(fd, how int) error {
+	return fcntlFlock(fd, how)
+}
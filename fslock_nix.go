@@ -1,95 +1,746 @@
 // Copyright 2016 Canonical Ltd.
 // Licensed under the LGPLv3, see LICENCE file for details.
 
-//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
-// +build darwin dragonfly freebsd linux netbsd openbsd
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
 
 package fslock
 
 import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"sync"
 	"syscall"
 	"time"
 )
 
+// features is what Features reports here.
+const features = Locking | SharedLocks | RangeLocks | ContextCancel | PIDRecords | dirLocks | ofdLocks
+
 // Lock implements cross-process locks using syscalls.
 // This implementation is based on flock syscall.
 type Lock struct {
 	filename string
 	fd       int
+	opts     options
+
+	// given is the descriptor passed to NewFromFd, or -1.  It is never
+	// closed, only unlocked.
+	given int
+
+	mu        sync.Mutex
+	held      bool
+	heldSince time.Time
+	// releasedAt is when the lock was last released, for LockFair.
+	releasedAt time.Time
+	depth      int
+	stats      LockStats
+	// rnd jitters the waits of LockWithRetry and LockFair, and is created
+	// on first use.
+	rnd *rand.Rand
+
+	// refMu is held while the lock is acquired for a first reference.
+	refMu sync.Mutex
+	refs  int
+}
+
+// New returns a new lock around the given file, configured by any options
+// given.
+func New(filename string, opts ...Option) *Lock {
+	return &Lock{filename: filename, fd: -1, given: -1, opts: newOptions(opts)}
 }
 
-// New returns a new lock around the given file.
-func New(filename string) *Lock {
-	return &Lock{filename: filename, fd: -1}
+// NewFromFd returns a new lock around the already open file descriptor fd,
+// configured by any options given, for processes that are handed descriptors
+// by a supervisor and can't open the lock file themselves.  The name is used in
+// errors and log messages, and by the methods that work with the file by
+// name, such as HolderPID and UnlockAndRemove.
+//
+// Unlock releases the lock but leaves fd open for the caller to close once the
+// lock is no longer needed, unless LockFile has handed it over, after which
+// the lock opens name like any other.  Range locks taken through fd have to be
+// released with UnlockRange.
+func NewFromFd(fd int, name string, opts ...Option) *Lock {
+	l := New(name, opts...)
+	l.given = fd
+	return l
 }
 
-// Lock locks the lock.  This call will block until the lock is available.
+// NewDir returns a new lock around the given directory, which must exist,
+// configured by any options given, for keeping other processes from working in
+// the directory at the same time.  The directory itself is locked, so nothing
+// is created in it.  On Windows and Plan 9, which can't lock directories, a
+// lock file named .lock in the directory, hidden on Windows, is used instead,
+// so every process using the lock must use NewDir.
+//
+// Directories can't hold a PID, so LockWithPID and BreakStaleLock don't work
+// with directory locks, and only the Flock backend can lock them exclusively,
+// which rules out Solaris, illumos and AIX.
+func NewDir(path string, opts ...Option) *Lock {
+	l := New(path, opts...)
+	l.opts.dir = true
+	return l
+}
+
+// Lock locks the lock.  This call will block until the lock is available, or
+// until the timeout set by WithDefaultTimeout expires or the context given to
+// NewWithContext is done.
 func (l *Lock) Lock() error {
-	if err := l.open(); err != nil {
-		return err
+	if l.opts.defaultTimeout >= 0 {
+		return l.LockWithTimeout(l.opts.defaultTimeout)
 	}
-	return syscall.Flock(l.fd, syscall.LOCK_EX)
+	return l.LockWithContext(l.context())
 }
 
 // TryLock attempts to lock the lock.  This method will return ErrLocked
 // immediately if the lock cannot be acquired.
 func (l *Lock) TryLock() error {
-	if err := l.open(); err != nil {
+	return l.flock(context.Background(), lockEx|lockNb)
+}
+
+// TryLockContextOnce makes a single attempt to lock the lock, as TryLock
+// does, but gives up if the context is done while the lock file is being
+// opened, which can hang on an unresponsive network filesystem, returning the
+// context's error, or the cause it was canceled with, if any.  Unlike
+// LockWithContext it never waits for the lock, returning ErrLocked if it is
+// held.  A context that is already done still gets the one attempt.
+func (l *Lock) TryLockContextOnce(ctx context.Context) error {
+	return l.flock(ctx, lockEx|lockNb)
+}
+
+// RLock locks the lock for shared use.  Any number of shared holders may hold
+// the lock at once, but an exclusive holder excludes them all.  This call will
+// block until the lock is available.
+//
+// A Lock instance holds either a shared or an exclusive lock at a time; to
+// switch between the two, call Upgrade or Downgrade.
+func (l *Lock) RLock() error {
+	return l.flock(context.Background(), lockSh)
+}
+
+// TryRLock attempts to lock the lock for shared use.  This method will return
+// ErrLocked immediately if the lock is held exclusively by someone else.
+func (l *Lock) TryRLock() error {
+	return l.flock(context.Background(), lockSh|lockNb)
+}
+
+// Upgrade converts a shared lock held by this instance into an exclusive one,
+// blocking until no other shared holders remain.  If the lock isn't held,
+// Upgrade locks it like Lock does.
+//
+// The conversion isn't atomic with the Flock backend: flock drops the shared
+// lock before waiting for the exclusive one, so another process may take the
+// lock exclusively in between, and whatever was read under the shared lock
+// must be read again afterwards.  Record locks, used by the OFD and Fcntl
+// backends and on Solaris, illumos and AIX, are converted in place.
+func (l *Lock) Upgrade() error {
+	if !l.Held() {
+		return l.Lock()
+	}
+	l.logf("waiting")
+	if err := lockFd(l.opts.backend, l.fd, lockEx); err != nil {
+		l.logf("upgrade failed: %v", err)
+		return l.pathError("lock", err)
+	}
+	l.logf("upgraded")
+	return nil
+}
+
+// TryUpgrade attempts to convert a shared lock held by this instance into an
+// exclusive one, returning ErrLocked immediately if anyone else holds the
+// lock.  The shared lock is kept when that happens, except with the Flock
+// backend in the rare case that another process takes the lock exclusively
+// in the moment flock drops it for the conversion; the lock is then lost, and
+// Held reports false.  If the lock isn't held, TryUpgrade locks it like
+// TryLock does.
+func (l *Lock) TryUpgrade() error {
+	if !l.Held() {
+		return l.TryLock()
+	}
+	err := lockFd(l.opts.backend, l.fd, lockEx|lockNb)
+	if err == nil {
+		l.logf("upgraded")
+		return nil
+	}
+	if err != syscall.EWOULDBLOCK {
+		l.logf("upgrade failed: %v", err)
+		return l.pathError("lock", err)
+	}
+	l.logf("already locked")
+	// A failed flock conversion may have dropped the shared lock, so take it
+	// back; record locks still hold it, and this changes nothing.
+	if err := lockFd(l.opts.backend, l.fd, lockSh|lockNb); err != nil {
+		l.logf("lost shared lock: %v", err)
+		l.released()
+		l.close()
+	}
+	return ErrLocked
+}
+
+// Downgrade converts an exclusive lock held by this instance into a shared
+// one, letting other readers in while this instance keeps reading.  Unlike
+// Upgrade, the conversion happens in place whatever the backend, so no writer
+// can take the lock in between and Downgrade never waits.  If the lock isn't
+// held, Downgrade locks it like RLock does.
+func (l *Lock) Downgrade() error {
+	if !l.Held() {
+		return l.RLock()
+	}
+	if err := lockFd(l.opts.backend, l.fd, lockSh); err != nil {
+		l.logf("downgrade failed: %v", err)
+		return l.pathError("lock", err)
+	}
+	l.logf("downgraded")
+	return nil
+}
+
+// flock opens the lock file, giving up if ctx is done first, and locks it as
+// specified by how, returning ErrLocked if LOCK_NB is given and the lock is
+// not available.
+func (l *Lock) flock(ctx context.Context, how int) error {
+	if err := l.advisoryOnly(); err != nil {
+		return err
+	}
+	if done, err := l.reenter(); done {
 		return err
 	}
-	err := syscall.Flock(l.fd, syscall.LOCK_EX|syscall.LOCK_NB)
+	start := l.startWait()
+	if err := l.openContext(ctx); err != nil {
+		return err
+	}
+	// Try without waiting first, to tell whether the lock is contended.
+	err := lockFd(l.opts.backend, l.fd, how|lockNb)
+	if err == syscall.EWOULDBLOCK {
+		l.contended()
+		if how&lockNb == 0 {
+			l.logf("waiting")
+			err = lockFd(l.opts.backend, l.fd, how)
+		}
+	}
 	if err != nil {
-		syscall.Close(l.fd)
-	} else {
-		syscall.CloseOnExec(l.fd)
+		// Don't keep the file open after failing to lock it, unless we were
+		// asked to.
+		if !l.opts.keepOpen {
+			l.close()
+		}
+		if err == syscall.EWOULDBLOCK {
+			l.logf("already locked")
+			return ErrLocked
+		}
+		l.logf("lock failed: %v", err)
+		return l.pathError("lock", err)
+	}
+	if err := l.checkStale(); err != nil {
+		l.close()
+		return err
 	}
+	l.acquired(start)
+	return nil
+}
+
+// IsLocked reports whether the lock is currently held, exclusively or shared,
+// by anyone, including this instance.  It does not acquire the lock or
+// create the lock file, and leaves any lock held by this instance untouched.
+// With record locks, as with the Fcntl backend, the lock file is left open
+// until Unlock, since closing it would release the process's record locks on
+// it.
+func (l *Lock) IsLocked() (bool, error) {
+	if (l.opts.backend == Fcntl || flockIsFcntl) && l.Held() {
+		// Our own record locks never conflict with a probe from the same
+		// process, so we have to know about them.
+		return true, nil
+	}
+	if l.opts.backend == Fcntl || flockIsFcntl {
+		return l.probeRecord()
+	}
+	if l.given != -1 {
+		// The lock file might not be ours to open, so probe through the
+		// descriptor we were given, unless that holds the lock already.
+		if l.Held() {
+			return true, nil
+		}
+		return l.probe(l.given)
+	}
+	// OFD locks can only be locked exclusively through a descriptor open for
+	// writing.
+	mode := syscall.O_RDONLY
+	if l.opts.backend != Flock {
+		mode = syscall.O_RDWR
+	}
+	fd, err := syscall.Open(l.filename, mode|syscall.O_CLOEXEC, 0)
+	if err == syscall.ENOENT {
+		return false, nil
+	}
+	if err != nil {
+		return false, l.pathError("open", err)
+	}
+	defer syscall.Close(fd)
+	return l.probe(fd)
+}
+
+// probeRecord reports whether another process holds a record lock on the
+// lock file, asking with F_GETLK, which changes nothing, through the lock's
+// own descriptor.  Closing any descriptor for the file would release every
+// record lock this process holds on it, so if the file isn't open yet it is
+// opened, without being created, and kept open until Unlock, as with
+// WithKeepOpen.
+func (l *Lock) probeRecord() (bool, error) {
+	fd := l.fd
+	if fd == -1 {
+		fd = l.given
+	}
+	if fd == -1 {
+		var err error
+		fd, err = syscall.Open(l.filename, syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+		if err == syscall.ENOENT {
+			return false, nil
+		}
+		if err != nil {
+			return false, l.pathError("open", err)
+		}
+		l.fd = fd
+	}
+	lk := syscall.Flock_t{Type: syscall.F_WRLCK, Whence: io.SeekStart}
+	err := syscall.FcntlFlock(uintptr(fd), syscall.F_GETLK, &lk)
+	for err == syscall.EINTR {
+		err = syscall.FcntlFlock(uintptr(fd), syscall.F_GETLK, &lk)
+	}
+	if err != nil {
+		return false, l.pathError("lock", err)
+	}
+	return lk.Type != syscall.F_UNLCK, nil
+}
+
+// probe reports whether the lock is held by anyone else, by trying to lock it
+// through fd.
+func (l *Lock) probe(fd int) (bool, error) {
+	err := lockFd(l.opts.backend, fd, lockEx|lockNb)
 	if err == syscall.EWOULDBLOCK {
-		return ErrLocked
+		return true, nil
+	}
+	if err != nil {
+		return false, l.pathError("lock", err)
 	}
+	return false, l.pathError("unlock", lockFd(l.opts.backend, fd, lockUn))
+}
+
+// writeRecord replaces the content of the lock file with record.
+func (l *Lock) writeRecord(record []byte) error {
+	if err := syscall.Ftruncate(l.fd, 0); err != nil {
+		return err
+	}
+	_, err := syscall.Pwrite(l.fd, record, 0)
 	return err
 }
 
+// readRecord returns the content of the lock file.  While the file is open it
+// is read through l.fd, as opening and closing another descriptor for it would
+// release every record lock this process holds on it.
+func (l *Lock) readRecord() ([]byte, error) {
+	if l.fd == -1 {
+		return ioutil.ReadFile(l.filename)
+	}
+	var st syscall.Stat_t
+	if err := syscall.Fstat(l.fd, &st); err != nil {
+		return nil, err
+	}
+	record := make([]byte, st.Size)
+	n := 0
+	for n < len(record) {
+		m, err := syscall.Pread(l.fd, record[n:], int64(n))
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if m == 0 {
+			break
+		}
+		n += m
+	}
+	return record[:n], nil
+}
+
+// open opens the lock file, unless this instance already has it open.
 func (l *Lock) open() error {
-	fd, err := syscall.Open(l.filename, syscall.O_CREAT|syscall.O_RDWR, 0600)
+	if l.fd != -1 {
+		return nil
+	}
+	if l.given != -1 {
+		l.fd = l.given
+		return nil
+	}
+	fd, err := l.openFile(0)
 	if err != nil {
 		return err
 	}
 	l.fd = fd
+	l.logf("opened")
 	return nil
 }
 
-// Unlock unlocks the lock.
+// openContext opens the lock file like open does, but gives up when ctx is
+// done, as opening a file on an unresponsive network filesystem can hang.
+// An open given up on is closed if it ever completes.
+func (l *Lock) openContext(ctx context.Context) error {
+	// A context that is already done still gets one attempt at the lock,
+	// as with a lock timeout too short to wait for anything.
+	if l.fd != -1 || l.given != -1 || ctx.Done() == nil || ctx.Err() != nil {
+		return l.open()
+	}
+	type result struct {
+		fd  int
+		err error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		fd, err := l.openFile(0)
+		opened <- result{fd, err}
+	}()
+	select {
+	case r := <-opened:
+		if r.err != nil {
+			return r.err
+		}
+		l.fd = r.fd
+		l.logf("opened")
+		return nil
+	case <-ctx.Done():
+		go func() {
+			if r := <-opened; r.err == nil {
+				syscall.Close(r.fd)
+			}
+		}()
+		return contextError(ctx)
+	}
+}
+
+// openFile opens the lock file, creating it if need be, unless WithNoCreate
+// says not to, with any extra flags given, and returns its descriptor.
+func (l *Lock) openFile(extra int) (int, error) {
+	if err := l.mkdirAll(); err != nil {
+		return -1, l.pathError("open", err)
+	}
+	// Open close-on-exec so that child processes don't inherit the
+	// descriptor, and with it the lock.
+	flags := syscall.O_CREAT | syscall.O_RDWR | syscall.O_CLOEXEC
+	if l.opts.dir {
+		// flock only needs a descriptor, and directories can only be
+		// opened for reading.
+		flags = syscall.O_RDONLY | syscall.O_DIRECTORY | syscall.O_CLOEXEC
+	} else if l.opts.noCreate && extra&syscall.O_EXCL == 0 {
+		flags &^= syscall.O_CREAT
+	}
+	var fd int
+	var err error
+	delay := time.Millisecond
+	for attempt := 1; ; attempt++ {
+		if l.opts.chown && flags&syscall.O_CREAT != 0 {
+			fd, err = l.create(flags | extra)
+		} else {
+			fd, err = sysOpen(l.filename, flags|extra, uint32(l.opts.mode.Perm()))
+		}
+		if !transientOpenError(err) || attempt >= l.opts.openAttempts {
+			break
+		}
+		l.logf("open failed, retrying: %v", err)
+		time.Sleep(delay)
+		if delay < 500*time.Millisecond {
+			delay *= 2
+		}
+	}
+	if err == syscall.EEXIST {
+		return -1, ErrExists
+	}
+	if err != nil {
+		l.logf("open failed: %v", err)
+		if err == syscall.EISDIR {
+			err = ErrNotRegularFile
+		}
+		if err == syscall.ENOENT && flags&syscall.O_CREAT == 0 && !l.opts.dir {
+			err = ErrNotExist
+		}
+		return -1, l.pathError("open", err)
+	}
+	return fd, nil
+}
+
+// sysOpen is the function the lock file is opened with, which tests replace to
+// simulate failures.
+var sysOpen = syscall.Open
+
+// transientOpenError reports whether opening the lock file failed in a way
+// that trying again shortly might not, which WithOpenRetry retries.
+func transientOpenError(err error) bool {
+	switch err {
+	case syscall.EINTR, syscall.EAGAIN, syscall.ETXTBSY, syscall.EMFILE, syscall.ENFILE:
+		return true
+	}
+	return false
+}
+
+// create opens the lock file with the given flags, first trying to create it
+// so that a new file can be given the owner and exact mode that WithChown asks
+// for.  A file that can't be given them is removed again.
+func (l *Lock) create(flags int) (int, error) {
+	perm := uint32(l.opts.mode.Perm())
+	fd, err := sysOpen(l.filename, flags|syscall.O_EXCL, perm)
+	if err == syscall.EEXIST && flags&syscall.O_EXCL == 0 {
+		return sysOpen(l.filename, flags, perm)
+	}
+	if err != nil {
+		return -1, err
+	}
+	err = syscall.Fchown(fd, l.opts.uid, l.opts.gid)
+	if err == nil {
+		err = syscall.Fchmod(fd, perm)
+	}
+	if err != nil {
+		syscall.Unlink(l.filename)
+		syscall.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// touch sets the lock file's access and modification times to t.  It goes by
+// name rather than through l.fd, which Unlock may be closing meanwhile.
+func (l *Lock) touch(t time.Time) error {
+	return os.Chtimes(l.filename, t, t)
+}
+
+// CreateLock creates the lock file and locks it, returning ErrExists if the
+// file already exists, for pidfile-style locks where the file existing at all
+// means the lock is taken.  It doesn't wait: if someone opens the new file
+// and locks it first, CreateLock returns ErrLocked.  Like LockWithPID, it
+// records this process's PID in the file.
+//
+// The file is left behind by a holder that crashes, and until it is removed
+// CreateLock keeps returning ErrExists.  BreakStaleLock can tell whether the
+// PID recorded belongs to a process that has gone and take the lock over, and
+// UnlockAndRemove removes the file when the lock is no longer needed.
+// Directories always exist, so CreateLock on a directory lock returns
+// ErrExists.
+func (l *Lock) CreateLock() error {
+	if err := l.advisoryOnly(); err != nil {
+		return err
+	}
+	if l.Held() {
+		return ErrAlreadyHeld
+	}
+	if l.fd != -1 || l.given != -1 || l.opts.dir {
+		return ErrExists
+	}
+	fd, err := l.openFile(syscall.O_EXCL)
+	if err == ErrExists {
+		l.logf("already exists")
+	}
+	if err != nil {
+		return err
+	}
+	l.fd = fd
+	l.logf("created")
+	if err := l.flock(context.Background(), lockEx|lockNb); err != nil {
+		return err
+	}
+	return l.recordPID()
+}
+
+// Unlock unlocks the lock, whether it was acquired exclusively or shared.
+// The lock is released before the lock file is closed, so that the two can
+// fail separately: an error for the "unlock" operation means the lock may not
+// have been released, though closing the file should still have released it,
+// while one for "close" comes after the lock was released.
+// Unlocking an instance that doesn't hold the lock does nothing and returns
+// nil, or ErrNotHeld with WithStrictUnlock.
 func (l *Lock) Unlock() error {
+	if l.leave() {
+		return nil
+	}
+	notHeld := l.unlockNotHeld()
 	// -1 represents that failed to open the file
 	if l.fd == -1 {
+		return notHeld
+	}
+	l.released()
+	if err := l.close(); err != nil {
+		return err
+	}
+	return notHeld
+}
+
+// LockFile locks the lock like Lock does, then hands the lock file over to the
+// caller, open for reading and writing, so that its content can be used under
+// the lock.  Closing the file releases the lock, and until the lock is next
+// acquired Unlock does nothing, however many times a reentrant lock was held.
+func (l *Lock) LockFile() (*os.File, error) {
+	if err := l.Lock(); err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(l.fd), l.filename)
+	l.fd = -1
+	l.given = -1
+	l.disown()
+	return f, nil
+}
+
+// Fd returns the descriptor of the lock file, and whether it is open, for
+// callers that watch it from their own event loop.  The file is open while
+// the lock is held, and between locks too with WithKeepOpen, NewFromFd or a
+// range lock.  The descriptor still belongs to the lock: closing it, or
+// locking or unlocking it other than through the lock, releases or confuses
+// the lock, and it is only good until Unlock closes it.
+func (l *Lock) Fd() (uintptr, bool) {
+	if l.fd == -1 {
+		return 0, false
+	}
+	return uintptr(l.fd), true
+}
+
+// UnlockAndRemove removes the lock file, then unlocks the lock, for lock files
+// that shouldn't outlive their use.  The lock must be held exclusively.  If
+// the lock file has since been replaced by another file, that is left alone.
+// A reentrant lock held more than once, or a lock not held at all, even if
+// IsLocked or a range lock left the file open, is only unlocked, as by Unlock.
+//
+// Removing a lock file is only safe if nobody else can be waiting for it: a
+// process that opened the file before it was removed goes on to lock the
+// removed file once it is unlocked, while one that opens it afterwards creates
+// and locks a new file, and neither excludes the other.
+func (l *Lock) UnlockAndRemove() error {
+	if !l.Held() || l.nested() {
+		return l.Unlock()
+	}
+	err := l.remove()
+	if uerr := l.Unlock(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// remove removes the lock file, provided it is still the file open as l.fd.
+func (l *Lock) remove() error {
+	same, err := l.sameFile()
+	if err != nil || !same {
+		return err
+	}
+	return l.pathError("remove", syscall.Unlink(l.filename))
+}
+
+// checkStale returns ErrStale if WithStaleCheck was given and the file locked
+// through l.fd is no longer the lock file.
+func (l *Lock) checkStale() error {
+	if !l.opts.staleCheck {
 		return nil
 	}
-	return syscall.Close(l.fd)
+	same, err := l.sameFile()
+	if err != nil {
+		return err
+	}
+	if !same {
+		l.logf("lock file replaced while locking")
+		return ErrStale
+	}
+	return nil
 }
 
-// LockWithTimeout tries to lock the lock until the timeout expires.  If the
-// timeout expires, this method will return ErrTimeout.
-func (l *Lock) LockWithTimeout(timeout time.Duration) error {
-	if err := l.open(); err != nil {
+// sameFile reports whether the file open as l.fd is still the lock file,
+// rather than having been removed or replaced.
+func (l *Lock) sameFile() (bool, error) {
+	var open, named syscall.Stat_t
+	if err := syscall.Fstat(l.fd, &open); err != nil {
+		return false, l.pathError("stat", err)
+	}
+	if err := syscall.Stat(l.filename, &named); err != nil {
+		if err == syscall.ENOENT {
+			return false, nil
+		}
+		return false, l.pathError("stat", err)
+	}
+	return open.Dev == named.Dev && open.Ino == named.Ino, nil
+}
+
+// close closes the lock file, releasing any lock held through it, and
+// returns the error unlocking it, if any, or else the error closing it.  The
+// descriptor given to NewFromFd is only unlocked.
+func (l *Lock) close() error {
+	// Unlock explicitly rather than leaving it to the close, which doesn't
+	// release a flock while a duplicate of the descriptor is still open.
+	err := l.pathError("unlock", lockFd(l.opts.backend, l.fd, lockUn))
+	if l.given != -1 && l.fd == l.given {
+		l.fd = -1
 		return err
 	}
-	result := make(chan error)
-	cancel := make(chan struct{})
-	go func() {
-		err := syscall.Flock(l.fd, syscall.LOCK_EX)
-		select {
-		case <-cancel:
-			// Timed out, cleanup if necessary.
-			syscall.Flock(l.fd, syscall.LOCK_UN)
-			syscall.Close(l.fd)
-		case result <- err:
+	// A close interrupted by a signal isn't retried, as the descriptor is
+	// gone regardless, and may already belong to another file.
+	if cerr := syscall.Close(l.fd); err == nil {
+		err = l.pathError("close", cerr)
+	}
+	l.fd = -1
+	return err
+}
+
+// LockWithContext tries to lock the lock until the context is done.  If the
+// context is done first, this method will return the context's error, or the
+// cause it was canceled with, if any.
+func (l *Lock) LockWithContext(ctx context.Context) error {
+	if ctx.Done() == nil {
+		// This context can never be canceled, so just wait.
+		return l.flock(context.Background(), lockEx)
+	}
+	if err := l.advisoryOnly(); err != nil {
+		return err
+	}
+	if done, err := l.reenter(); done {
+		return err
+	}
+	start := l.startWait()
+	if err := l.openContext(ctx); err != nil {
+		if err == contextError(ctx) {
+			l.logf("gave up waiting: %v", err)
 		}
-	}()
-	select {
-	case err := <-result:
 		return err
-	case <-time.After(timeout):
-		close(cancel)
-		return ErrTimeout
+	}
+	l.logf("waiting")
+	// Nothing interrupts a blocked flock, so rather than leave a goroutine
+	// blocked in one when the context is done, poll, backing off like
+	// cmd/go's lockedfile does.
+	delay := time.Millisecond
+	counted := false
+	for {
+		err := lockFd(l.opts.backend, l.fd, lockEx|lockNb)
+		if err == nil {
+			if err := l.checkStale(); err != nil {
+				l.close()
+				return err
+			}
+			l.acquired(start)
+			return nil
+		}
+		if err != syscall.EWOULDBLOCK {
+			l.close()
+			l.logf("lock failed: %v", err)
+			return l.pathError("lock", err)
+		}
+		if !counted {
+			l.contended()
+			counted = true
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			l.close()
+			l.logf("gave up waiting: %v", contextError(ctx))
+			return contextError(ctx)
+		case <-timer.C:
+		}
+		if delay < 500*time.Millisecond {
+			delay *= 2
+		}
 	}
 }
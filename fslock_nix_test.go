@@ -0,0 +1,578 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package fslock_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/xianic/fslock"
+)
+
+func (s *fslockSuite) TestLockNotInherited(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	c.Assert(lock.Lock(), gc.IsNil)
+	defer lock.Unlock()
+	fd, ok := lock.Fd()
+	c.Assert(ok, gc.Equals, true)
+
+	// The descriptor is closed on exec, so a child doesn't get a copy of it.
+	cmd := exec.Command(os.Args[0], "-test.run", "^TestInheritedFdHelper$")
+	cmd.Env = append(
+		os.Environ(),
+		"FSLOCK_TEST_HELPER_WANTED=1",
+		"FSLOCK_TEST_HELPER_PATH="+path,
+		fmt.Sprintf("FSLOCK_TEST_HELPER_FD=%d", fd),
+	)
+	out, err := cmd.CombinedOutput()
+	c.Assert(err, gc.IsNil, gc.Commentf("%s", out))
+}
+
+// TestInheritedFdHelper fails, for TestLockNotInherited, if the descriptor
+// numbered FSLOCK_TEST_HELPER_FD is open on the file FSLOCK_TEST_HELPER_PATH.
+func TestInheritedFdHelper(t *testing.T) {
+	if os.Getenv("FSLOCK_TEST_HELPER_WANTED") == "" {
+		return
+	}
+	path := os.Getenv("FSLOCK_TEST_HELPER_PATH")
+	fd, err := strconv.Atoi(os.Getenv("FSLOCK_TEST_HELPER_FD"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want, got syscall.Stat_t
+	if err := syscall.Stat(path, &want); err != nil {
+		t.Fatal(err)
+	}
+	if syscall.Fstat(fd, &got) == nil && got.Dev == want.Dev && got.Ino == want.Ino {
+		t.Fatalf("descriptor %d for %q was inherited", fd, path)
+	}
+}
+
+func (s *fslockSuite) TestLockDoesNotLeakFds(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	holder := fslock.New(path)
+
+	before := openFds(c)
+	for i := 0; i < 20; i++ {
+		c.Assert(lock.Lock(), gc.IsNil)
+		c.Assert(lock.Lock(), gc.Equals, fslock.ErrAlreadyHeld)
+		c.Assert(lock.Unlock(), gc.IsNil)
+
+		c.Assert(holder.Lock(), gc.IsNil)
+		c.Assert(lock.TryLock(), gc.Equals, fslock.ErrLocked)
+		c.Assert(lock.TryLock(), gc.Equals, fslock.ErrLocked)
+		c.Assert(holder.Unlock(), gc.IsNil)
+	}
+	// Descriptors left by earlier tests, such as for their helper processes,
+	// may be closed meanwhile, but a leak would add one per iteration.
+	c.Assert(openFds(c) <= before, gc.Equals, true, gc.Commentf("%d fds open, want at most %d", openFds(c), before))
+}
+
+// openFds returns the number of file descriptors open in this process.
+func openFds(c *gc.C) int {
+	entries, err := os.ReadDir("/dev/fd")
+	c.Assert(err, gc.IsNil)
+	return len(entries)
+}
+
+func (s *fslockSuite) TestWithFileMode(c *gc.C) {
+	defer syscall.Umask(syscall.Umask(0))
+
+	dir := c.MkDir()
+	lock := fslock.New(filepath.Join(dir, "group"), fslock.WithFileMode(0660))
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	info, err := os.Stat(filepath.Join(dir, "group"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Mode().Perm(), gc.Equals, os.FileMode(0660))
+
+	// The mode of an existing lock file is left alone.
+	lock = fslock.New(filepath.Join(dir, "group"), fslock.WithFileMode(0644))
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	info, err = os.Stat(filepath.Join(dir, "group"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Mode().Perm(), gc.Equals, os.FileMode(0660))
+
+	lock = fslock.New(filepath.Join(dir, "default"))
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	info, err = os.Stat(filepath.Join(dir, "default"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.Mode().Perm(), gc.Equals, os.FileMode(0600))
+}
+
+func (s *fslockSuite) TestErrorsWrapErrno(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "missing", "lockfile")
+	err := fslock.New(path).TryLock()
+	var errno syscall.Errno
+	c.Assert(errors.As(err, &errno), gc.Equals, true)
+	c.Assert(errno, gc.Equals, syscall.ENOENT)
+}
+
+func (s *fslockSuite) TestUnlockAndRemoveNeedsHold(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+	defer holder.Unlock()
+
+	// Neither looking at the lock nor locking a range of it leaves anything
+	// to remove from under the holder.
+	lock := fslock.New(path, fslock.WithBackend(fslock.Fcntl))
+	_, err := lock.IsLocked()
+	c.Assert(err, gc.IsNil)
+	c.Assert(lock.UnlockAndRemove(), gc.IsNil)
+	_, err = os.Stat(path)
+	c.Assert(err, gc.IsNil)
+
+	lock = fslock.New(path)
+	c.Assert(lock.TryLockRange(0, 1, true), gc.IsNil)
+	c.Assert(lock.UnlockAndRemove(), gc.IsNil)
+	_, err = os.Stat(path)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *fslockSuite) TestUnlockAndRemoveLeavesReplacement(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "lockfile")
+	lock := fslock.New(path)
+	c.Assert(lock.Lock(), gc.IsNil)
+
+	replacement := filepath.Join(dir, "replacement")
+	c.Assert(os.WriteFile(replacement, nil, 0600), gc.IsNil)
+	c.Assert(os.Rename(replacement, path), gc.IsNil)
+	c.Assert(lock.UnlockAndRemove(), gc.IsNil)
+	_, err := os.Stat(path)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *fslockSuite) TestNewDirLocksDirectory(c *gc.C) {
+	switch runtime.GOOS {
+	case "aix", "illumos", "solaris":
+		c.Skip("directories can't be locked exclusively with fcntl")
+	}
+	dir := c.MkDir()
+	lock := fslock.NewDir(dir)
+	c.Assert(lock.Lock(), gc.IsNil)
+	defer lock.Unlock()
+	entries, err := os.ReadDir(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 0)
+}
+
+func (s *fslockSuite) TestNewFromFd(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+	fd := int(f.Fd())
+
+	lock := fslock.NewFromFd(fd, path)
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(fslock.New(path).TryLock(), gc.Equals, fslock.ErrLocked)
+	locked, err := lock.IsLocked()
+	c.Assert(err, gc.IsNil)
+	c.Assert(locked, gc.Equals, true)
+
+	// Unlocking leaves the descriptor open, and it can be locked again.
+	c.Assert(lock.Unlock(), gc.IsNil)
+	var st syscall.Stat_t
+	c.Assert(syscall.Fstat(fd, &st), gc.IsNil)
+	locked, err = lock.IsLocked()
+	c.Assert(err, gc.IsNil)
+	c.Assert(locked, gc.Equals, false)
+	c.Assert(lock.TryLock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+
+	other := fslock.New(path)
+	c.Assert(other.TryLock(), gc.IsNil)
+	c.Assert(lock.TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(syscall.Fstat(fd, &st), gc.IsNil)
+	c.Assert(other.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestWithKeepOpen(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path, fslock.WithKeepOpen())
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+
+	before := openFds(c)
+	for i := 0; i < 20; i++ {
+		c.Assert(lock.TryLock(), gc.Equals, fslock.ErrLocked)
+	}
+	c.Assert(openFds(c) <= before+1, gc.Equals, true, gc.Commentf("%d fds open, want at most %d", openFds(c), before+1))
+
+	// The file kept open doesn't hold the lock.
+	c.Assert(holder.Unlock(), gc.IsNil)
+	other := fslock.New(path)
+	c.Assert(other.TryLock(), gc.IsNil)
+	c.Assert(other.Unlock(), gc.IsNil)
+	c.Assert(lock.UnlockAndRemove(), gc.IsNil)
+	_, err := os.Stat(path)
+	c.Assert(err, gc.IsNil)
+
+	c.Assert(lock.TryLock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(openFds(c) <= before, gc.Equals, true, gc.Commentf("%d fds open, want at most %d", openFds(c), before))
+}
+
+func (s *fslockSuite) TestWithStaleCheck(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "testing")
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+
+	// Keeping the file open after failing to lock it leaves the lock to lock
+	// the same file next time, as if it had been waiting all along.
+	lock := fslock.New(path, fslock.WithStaleCheck(), fslock.WithKeepOpen())
+	c.Assert(lock.TryLock(), gc.Equals, fslock.ErrLocked)
+
+	replacement := filepath.Join(dir, "replacement")
+	c.Assert(os.WriteFile(replacement, nil, 0600), gc.IsNil)
+	c.Assert(os.Rename(replacement, path), gc.IsNil)
+	c.Assert(holder.Unlock(), gc.IsNil)
+
+	c.Assert(lock.TryLock(), gc.Equals, fslock.ErrStale)
+	c.Assert(lock.Held(), gc.Equals, false)
+
+	// Trying again locks the new file.
+	c.Assert(lock.TryLock(), gc.IsNil)
+	c.Assert(fslock.New(path).TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestLockErrorContention(c *gc.C) {
+	for i, test := range []struct {
+		err  error
+		want error
+	}{{
+		err:  nil,
+		want: nil,
+	}, {
+		err:  syscall.EWOULDBLOCK,
+		want: syscall.EWOULDBLOCK,
+	}, {
+		err:  syscall.EAGAIN,
+		want: syscall.EWOULDBLOCK,
+	}, {
+		err:  syscall.EACCES,
+		want: syscall.EWOULDBLOCK,
+	}, {
+		err:  syscall.EBADF,
+		want: syscall.EBADF,
+	}, {
+		err:  syscall.ENOLCK,
+		want: syscall.ENOLCK,
+	}} {
+		c.Logf("test %d: %v", i, test.err)
+		c.Check(fslock.LockError(test.err), gc.Equals, test.want)
+	}
+}
+
+func (s *fslockSuite) TestSimulatedLockFailures(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	var fail error
+	delay := time.Duration(0)
+	restore := fslock.SetLockFd(func(real func(fslock.Backend, int, int) error, backend fslock.Backend, fd, how int) error {
+		if how == fslock.LockUn {
+			return real(backend, fd, how)
+		}
+		time.Sleep(delay)
+		if fail != nil {
+			return fail
+		}
+		return real(backend, fd, how)
+	})
+	defer restore()
+
+	// Contention, without anyone else holding the lock.
+	fail = syscall.EWOULDBLOCK
+	c.Assert(lock.TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(lock.LockWithTimeout(shortWait), gc.Equals, fslock.ErrTimeout)
+	locked, err := lock.IsLocked()
+	c.Assert(err, gc.IsNil)
+	c.Assert(locked, gc.Equals, true)
+
+	// Other errors are wrapped.
+	fail = syscall.ETIMEDOUT
+	err = lock.TryLock()
+	c.Assert(errors.Is(err, syscall.ETIMEDOUT), gc.Equals, true)
+	c.Assert(lock.Held(), gc.Equals, false)
+
+	// A slow acquisition.
+	fail, delay = nil, shortWait
+	start := time.Now()
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(time.Since(start) >= shortWait, gc.Equals, true)
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestWithChown(c *gc.C) {
+	old := syscall.Umask(022)
+	defer syscall.Umask(old)
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path, fslock.WithFileMode(0660), fslock.WithChown(-1, os.Getgid()))
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	fi, err := os.Stat(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fi.Mode().Perm(), gc.Equals, os.FileMode(0660))
+	c.Assert(int(fi.Sys().(*syscall.Stat_t).Gid), gc.Equals, os.Getgid())
+
+	// An existing file is left alone.
+	c.Assert(os.Chmod(path, 0600), gc.IsNil)
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	fi, err = os.Stat(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fi.Mode().Perm(), gc.Equals, os.FileMode(0600))
+}
+
+func (s *fslockSuite) TestLockSurvivesSignals(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	kill := make(chan struct{})
+	procDone := LockFromAnotherProc(c, path, kill)
+
+	lock := fslock.New(path)
+	result := make(chan error, 1)
+	go func() {
+		result <- lock.Lock()
+	}()
+
+	// Signal the process while the lock waits, which can interrupt the
+	// thread blocked in flock.  SIGURG is the runtime's own preemption
+	// signal, so it is already handled.
+	for i := 0; i < 10; i++ {
+		time.Sleep(shortWait / 2)
+		c.Assert(syscall.Kill(os.Getpid(), syscall.SIGURG), gc.IsNil)
+	}
+	select {
+	case err := <-result:
+		c.Fatalf("lock returned while still held elsewhere: %v", err)
+	default:
+	}
+
+	close(kill)
+	<-procDone
+	select {
+	case err := <-result:
+		c.Assert(err, gc.IsNil)
+	case <-time.After(time.Second):
+		c.Fatalf("lock never acquired")
+	}
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestLockRetriesEINTR(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	const interruptions = 3
+	calls := 0
+	restore := fslock.SetApplyLock(func(real func(fslock.Backend, int, int) error, backend fslock.Backend, fd, how int) error {
+		if how == fslock.LockUn {
+			return real(backend, fd, how)
+		}
+		calls++
+		if calls <= interruptions {
+			return syscall.EINTR
+		}
+		return real(backend, fd, how)
+	})
+	defer restore()
+
+	lock := fslock.New(path)
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(calls, gc.Equals, interruptions+1)
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestUnlockErrors(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	c.Assert(lock.Lock(), gc.IsNil)
+	restore := fslock.SetLockFd(func(real func(fslock.Backend, int, int) error, backend fslock.Backend, fd, how int) error {
+		if how == fslock.LockUn {
+			return syscall.EIO
+		}
+		return real(backend, fd, how)
+	})
+	err := lock.Unlock()
+	restore()
+	c.Assert(errors.Is(err, syscall.EIO), gc.Equals, true)
+	c.Assert(err, gc.ErrorMatches, `fslock: unlock ".*": input/output error`)
+	c.Assert(lock.Held(), gc.Equals, false)
+
+	// The file was closed anyway, which released the lock.
+	other := fslock.New(path)
+	c.Assert(other.TryLock(), gc.IsNil)
+	c.Assert(other.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestFcntlLock(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	defer lock.Unlock()
+
+	kill := make(chan struct{})
+	procDone := LockFromAnotherProc(c, path, kill, "FSLOCK_TEST_HELPER_RANGE=0:10")
+	defer func() {
+		close(kill)
+		select {
+		case <-procDone:
+		case <-time.After(time.Second):
+		}
+	}()
+	time.Sleep(shortWait)
+
+	c.Assert(lock.FcntlLock(io.SeekStart, 0, 10, true, false), gc.Equals, fslock.ErrLocked)
+	// The lock file is freshly opened, so the current offset is zero.
+	c.Assert(lock.FcntlLock(io.SeekCurrent, 5, 1, false, false), gc.Equals, fslock.ErrLocked)
+	c.Assert(lock.FcntlLock(io.SeekStart, 10, 10, true, true), gc.IsNil)
+	c.Assert(lock.UnlockRange(10, 10), gc.IsNil)
+}
+
+func (s *fslockSuite) TestFd(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	_, ok := lock.Fd()
+	c.Assert(ok, gc.Equals, false)
+
+	c.Assert(lock.Lock(), gc.IsNil)
+	fd, ok := lock.Fd()
+	c.Assert(ok, gc.Equals, true)
+	var st syscall.Stat_t
+	c.Assert(syscall.Fstat(int(fd), &st), gc.IsNil)
+	fi, err := os.Stat(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fi.Sys().(*syscall.Stat_t).Ino, gc.Equals, st.Ino)
+
+	c.Assert(lock.Unlock(), gc.IsNil)
+	_, ok = lock.Fd()
+	c.Assert(ok, gc.Equals, false)
+}
+
+func (s *fslockSuite) TestWithOpenRetry(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	var fail []error
+	calls := 0
+	restore := fslock.SetOpen(func(path string, mode int, perm uint32) (int, error) {
+		calls++
+		if len(fail) > 0 {
+			err := fail[0]
+			fail = fail[1:]
+			return -1, err
+		}
+		return syscall.Open(path, mode, perm)
+	})
+	defer restore()
+
+	// By default nothing is retried.
+	fail = []error{syscall.EMFILE}
+	err := fslock.New(path).TryLock()
+	c.Assert(errors.Is(err, syscall.EMFILE), gc.Equals, true)
+	c.Assert(calls, gc.Equals, 1)
+
+	// Transient errors are retried up to the attempts given.
+	lock := fslock.New(path, fslock.WithOpenRetry(3))
+	calls, fail = 0, []error{syscall.EINTR, syscall.EMFILE}
+	c.Assert(lock.TryLock(), gc.IsNil)
+	c.Assert(calls, gc.Equals, 3)
+	c.Assert(lock.Unlock(), gc.IsNil)
+
+	calls, fail = 0, []error{syscall.EMFILE, syscall.EMFILE, syscall.ENFILE}
+	err = lock.TryLock()
+	c.Assert(errors.Is(err, syscall.ENFILE), gc.Equals, true)
+	c.Assert(calls, gc.Equals, 3)
+
+	// Others fail fast.
+	calls, fail = 0, []error{syscall.EACCES}
+	err = lock.TryLock()
+	c.Assert(errors.Is(err, syscall.EACCES), gc.Equals, true)
+	c.Assert(calls, gc.Equals, 1)
+}
+
+// tryLockFromAnotherProc reports whether another process can take the lock at
+// path right now, with any env given added to its environment.
+func tryLockFromAnotherProc(c *gc.C, path string, env ...string) bool {
+	cmd := exec.Command(os.Args[0], "-test.run", "TestLockFromOtherProcess")
+	cmd.Env = append(os.Environ(),
+		"FSLOCK_TEST_HELPER_WANTED=1",
+		"FSLOCK_TEST_HELPER_TRY=1",
+		"FSLOCK_TEST_HELPER_PATH="+path,
+	)
+	cmd.Env = append(cmd.Env, env...)
+	err := cmd.Run()
+	if err == nil {
+		return true
+	}
+	if exit, ok := err.(*exec.ExitError); ok && exit.ExitCode() == 3 {
+		return false
+	}
+	c.Fatalf("other process failed: %v", err)
+	return false
+}
+
+func (s *fslockSuite) TestRecordLockSurvivesReadingHolder(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path, fslock.WithBackend(fslock.Fcntl))
+	c.Assert(lock.LockWithPID(), gc.IsNil)
+	defer lock.Unlock()
+	checkReadingHolderKeepsLock(c, lock, path, "FSLOCK_TEST_HELPER_BACKEND=fcntl")
+
+	// Nor must probing it from another instance while this one holds a
+	// range.
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(lock.LockRange(0, 1, true), gc.IsNil)
+	locked, err := fslock.New(path, fslock.WithBackend(fslock.Fcntl)).IsLocked()
+	c.Assert(err, gc.IsNil)
+	c.Assert(locked, gc.Equals, false)
+	c.Assert(tryLockFromAnotherProc(c, path, "FSLOCK_TEST_HELPER_BACKEND=fcntl"), gc.Equals, false)
+}
+
+// TestDefaultLockSurvivesReadingHolder checks the same with the default
+// backend, which is built on record locks on Solaris, illumos and AIX.
+func (s *fslockSuite) TestDefaultLockSurvivesReadingHolder(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	c.Assert(lock.LockWithPID(), gc.IsNil)
+	defer lock.Unlock()
+	checkReadingHolderKeepsLock(c, lock, path)
+}
+
+func (s *fslockSuite) TestHolderPIDReadError(c *gc.C) {
+	_, err := fslock.New(c.MkDir()).HolderPID()
+	c.Assert(err, gc.ErrorMatches, `fslock: read ".*": .*is a directory`)
+}
+
+// checkReadingHolderKeepsLock checks that looking up who holds the lock
+// through the instance holding it doesn't release it, trying the lock from a
+// process with any env given.
+func checkReadingHolderKeepsLock(c *gc.C, lock *fslock.Lock, path string, env ...string) {
+	pid, err := lock.HolderPID()
+	c.Assert(err, gc.IsNil)
+	c.Assert(pid, gc.Equals, os.Getpid())
+	_, err = lock.WhoHolds()
+	c.Assert(err, gc.IsNil)
+	locked, err := lock.IsLocked()
+	c.Assert(err, gc.IsNil)
+	c.Assert(locked, gc.Equals, true)
+	c.Assert(tryLockFromAnotherProc(c, path, env...), gc.Equals, false)
+}
@@ -0,0 +1,154 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build !aix && !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !plan9 && !solaris && !windows
+// +build !aix,!darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!plan9,!solaris,!windows
+
+package fslock
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// features is what Features reports here: nothing.
+const features Feature = 0
+
+// Lock implements cross-process locks using syscalls.
+// This platform has no file locking that this package knows how to use, such
+// as js/wasm and wasip1, so every locking operation returns ErrUnsupported.
+// It exists so that packages importing fslock still build here.
+type Lock struct {
+	filename string
+	opts     options
+
+	mu        sync.Mutex
+	held      bool
+	heldSince time.Time
+	// releasedAt is when the lock was last released, for LockFair.
+	releasedAt time.Time
+	depth      int
+	stats      LockStats
+	// rnd jitters the waits of LockWithRetry and LockFair, and is created
+	// on first use.
+	rnd *rand.Rand
+
+	// refMu is held while the lock is acquired for a first reference.
+	refMu sync.Mutex
+	refs  int
+}
+
+// New returns a new lock around the given file, configured by any options
+// given.
+func New(filename string, opts ...Option) *Lock {
+	return &Lock{filename: filename, opts: newOptions(opts)}
+}
+
+// NewDir returns a new lock around the given directory, configured by any
+// options given.
+func NewDir(path string, opts ...Option) *Lock {
+	return New(path, opts...)
+}
+
+// Lock returns ErrUnsupported.
+func (l *Lock) Lock() error {
+	return ErrUnsupported
+}
+
+// TryLock returns ErrUnsupported.
+func (l *Lock) TryLock() error {
+	return ErrUnsupported
+}
+
+// TryLockContextOnce returns ErrUnsupported.
+func (l *Lock) TryLockContextOnce(ctx context.Context) error {
+	return ErrUnsupported
+}
+
+// RLock returns ErrUnsupported.
+func (l *Lock) RLock() error {
+	return ErrUnsupported
+}
+
+// TryRLock returns ErrUnsupported.
+func (l *Lock) TryRLock() error {
+	return ErrUnsupported
+}
+
+// Upgrade returns ErrUnsupported.
+func (l *Lock) Upgrade() error {
+	return ErrUnsupported
+}
+
+// TryUpgrade returns ErrUnsupported.
+func (l *Lock) TryUpgrade() error {
+	return ErrUnsupported
+}
+
+// Downgrade returns ErrUnsupported.
+func (l *Lock) Downgrade() error {
+	return ErrUnsupported
+}
+
+// LockRange returns ErrUnsupported.
+func (l *Lock) LockRange(offset, length int64, exclusive bool) error {
+	return ErrUnsupported
+}
+
+// TryLockRange returns ErrUnsupported.
+func (l *Lock) TryLockRange(offset, length int64, exclusive bool) error {
+	return ErrUnsupported
+}
+
+// UnlockRange returns ErrUnsupported.
+func (l *Lock) UnlockRange(offset, length int64) error {
+	return ErrUnsupported
+}
+
+// IsLocked returns ErrUnsupported.
+func (l *Lock) IsLocked() (bool, error) {
+	return false, ErrUnsupported
+}
+
+// CreateLock returns ErrUnsupported.
+func (l *Lock) CreateLock() error {
+	return ErrUnsupported
+}
+
+// touch returns ErrUnsupported.
+func (l *Lock) touch(t time.Time) error {
+	return ErrUnsupported
+}
+
+// Unlock returns ErrUnsupported.
+func (l *Lock) Unlock() error {
+	return ErrUnsupported
+}
+
+// LockFile returns ErrUnsupported.
+func (l *Lock) LockFile() (*os.File, error) {
+	return nil, ErrUnsupported
+}
+
+// UnlockAndRemove returns ErrUnsupported.
+func (l *Lock) UnlockAndRemove() error {
+	return ErrUnsupported
+}
+
+// LockWithContext returns ErrUnsupported.
+func (l *Lock) LockWithContext(ctx context.Context) error {
+	return ErrUnsupported
+}
+
+// writeRecord returns ErrUnsupported.
+func (l *Lock) writeRecord(record []byte) error {
+	return ErrUnsupported
+}
+
+// readRecord returns ErrUnsupported.
+func (l *Lock) readRecord() ([]byte, error) {
+	return nil, ErrUnsupported
+}
@@ -0,0 +1,382 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// features is what Features reports here, where exclusive-use files allow
+// neither shared nor byte-range locks, nor reading the holder's record from
+// anywhere but the holder.
+const features = Locking | ContextCancel | DirLocks | MandatoryLocks
+
+// Lock implements cross-process locks using syscalls.
+// This implementation is based on Plan 9's exclusive-use files, which only
+// one client may have open at a time.  There are no shared or byte-range
+// locks, so those methods return ErrUnsupported, and waiting for the lock is
+// done by polling.
+type Lock struct {
+	filename string
+	file     *os.File
+	opts     options
+
+	mu        sync.Mutex
+	held      bool
+	heldSince time.Time
+	// releasedAt is when the lock was last released, for LockFair.
+	releasedAt time.Time
+	depth      int
+	stats      LockStats
+	// rnd jitters the waits of LockWithRetry and LockFair, and is created
+	// on first use.
+	rnd *rand.Rand
+
+	// refMu is held while the lock is acquired for a first reference.
+	refMu sync.Mutex
+	refs  int
+}
+
+// New returns a new lock around the given file, configured by any options
+// given.
+func New(filename string, opts ...Option) *Lock {
+	return &Lock{filename: filename, opts: newOptions(opts)}
+}
+
+// NewDir returns a new lock around the given directory, which must exist,
+// configured by any options given, for keeping other processes from working in
+// the directory at the same time.  Plan 9 can't lock directories, so a lock
+// file named .lock in the directory is used instead, which every process using
+// the lock must get from NewDir.
+func NewDir(path string, opts ...Option) *Lock {
+	return New(filepath.Join(path, dirLockFile), opts...)
+}
+
+// Lock locks the lock.  This call will block until the lock is available, or
+// until the timeout set by WithDefaultTimeout expires or the context given to
+// NewWithContext is done.
+func (l *Lock) Lock() error {
+	if l.opts.defaultTimeout >= 0 {
+		return l.LockWithTimeout(l.opts.defaultTimeout)
+	}
+	return l.LockWithContext(l.context())
+}
+
+// TryLock attempts to lock the lock.  This method will return ErrLocked
+// immediately if the lock cannot be acquired.
+func (l *Lock) TryLock() error {
+	if done, err := l.reenter(); done {
+		return err
+	}
+	err := l.open(l.startWait())
+	if err == ErrLocked {
+		l.contended()
+		l.logf("already locked")
+	}
+	return err
+}
+
+// TryLockContextOnce makes a single attempt to lock the lock, as TryLock
+// does.  Opening a file can't be abandoned on Plan 9, so the context is
+// ignored.
+func (l *Lock) TryLockContextOnce(ctx context.Context) error {
+	return l.TryLock()
+}
+
+// RLock returns ErrUnsupported, as Plan 9 has no shared locks.
+func (l *Lock) RLock() error {
+	return ErrUnsupported
+}
+
+// TryRLock returns ErrUnsupported, as Plan 9 has no shared locks.
+func (l *Lock) TryRLock() error {
+	return ErrUnsupported
+}
+
+// Upgrade returns ErrUnsupported, as Plan 9 has no shared locks.
+func (l *Lock) Upgrade() error {
+	return ErrUnsupported
+}
+
+// TryUpgrade returns ErrUnsupported, as Plan 9 has no shared locks.
+func (l *Lock) TryUpgrade() error {
+	return ErrUnsupported
+}
+
+// Downgrade returns ErrUnsupported, as Plan 9 has no shared locks.
+func (l *Lock) Downgrade() error {
+	return ErrUnsupported
+}
+
+// LockRange returns ErrUnsupported, as Plan 9 has no byte-range locks.
+func (l *Lock) LockRange(offset, length int64, exclusive bool) error {
+	return ErrUnsupported
+}
+
+// TryLockRange returns ErrUnsupported, as Plan 9 has no byte-range locks.
+func (l *Lock) TryLockRange(offset, length int64, exclusive bool) error {
+	return ErrUnsupported
+}
+
+// UnlockRange returns ErrUnsupported, as Plan 9 has no byte-range locks.
+func (l *Lock) UnlockRange(offset, length int64) error {
+	return ErrUnsupported
+}
+
+// IsLocked reports whether the lock is currently held by anyone, including
+// this instance.  It does not acquire the lock or create the lock file, and
+// leaves any lock held by this instance untouched.
+func (l *Lock) IsLocked() (bool, error) {
+	f, err := os.Open(l.filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		if isLocked(err) {
+			return true, nil
+		}
+		return false, l.pathError("open", err)
+	}
+	return false, f.Close()
+}
+
+// touch sets the lock file's access and modification times to t.
+func (l *Lock) touch(t time.Time) error {
+	return os.Chtimes(l.filename, t, t)
+}
+
+// CreateLock creates the lock file and locks it, returning ErrExists if the
+// file already exists, for pidfile-style locks where the file existing at all
+// means the lock is taken.  Like LockWithPID, it records this process's PID in
+// the file.
+//
+// The file is left behind by a holder that crashes, and until it is removed
+// CreateLock keeps returning ErrExists.  BreakStaleLock can tell whether the
+// PID recorded belongs to a process that has gone and take the lock over, and
+// UnlockAndRemove removes the file when the lock is no longer needed.
+func (l *Lock) CreateLock() error {
+	if l.Held() {
+		return ErrAlreadyHeld
+	}
+	start := l.startWait()
+	if err := l.mkdirAll(); err != nil {
+		return l.pathError("open", err)
+	}
+	f, err := os.OpenFile(l.filename, os.O_RDWR|os.O_CREATE|os.O_EXCL, os.ModeExclusive|l.opts.mode.Perm())
+	if os.IsExist(err) {
+		l.logf("already exists")
+		return ErrExists
+	}
+	if err != nil {
+		l.logf("open failed: %v", err)
+		return l.pathError("open", err)
+	}
+	l.logf("created")
+	l.file = f
+	l.acquired(start)
+	return l.recordPID()
+}
+
+// Unlock unlocks the lock.
+// Unlocking an instance that doesn't hold the lock does nothing and returns
+// nil, or ErrNotHeld with WithStrictUnlock.
+func (l *Lock) Unlock() error {
+	if l.leave() {
+		return nil
+	}
+	notHeld := l.unlockNotHeld()
+	l.released()
+	if l.file == nil {
+		return notHeld
+	}
+	err := l.file.Close()
+	l.file = nil
+	if err != nil {
+		return l.pathError("close", err)
+	}
+	return notHeld
+}
+
+// LockFile locks the lock like Lock does, then hands the lock file over to the
+// caller, open for reading and writing, so that its content can be used under
+// the lock.  Closing the file releases the lock, and until the lock is next
+// acquired Unlock does nothing, however many times a reentrant lock was held.
+func (l *Lock) LockFile() (*os.File, error) {
+	if err := l.Lock(); err != nil {
+		return nil, err
+	}
+	f := l.file
+	l.file = nil
+	l.disown()
+	return f, nil
+}
+
+// UnlockAndRemove removes the lock file, then unlocks the lock, for lock files
+// that shouldn't outlive their use.  If the lock file has since been replaced
+// by another file, that is left alone.  A reentrant lock held more than once
+// is only unlocked, as by Unlock.
+//
+// Removing a lock file is only safe if nobody else can be waiting for it, as
+// anyone polling for it will create and lock a new file.
+func (l *Lock) UnlockAndRemove() error {
+	if !l.Held() || l.nested() {
+		return l.Unlock()
+	}
+	err := l.remove()
+	if uerr := l.Unlock(); err == nil {
+		err = uerr
+	}
+	return err
+}
+
+// remove removes the lock file, provided it is still the file open as l.file.
+func (l *Lock) remove() error {
+	open, err := l.file.Stat()
+	if err != nil {
+		return l.pathError("stat", err)
+	}
+	named, err := os.Stat(l.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return l.pathError("stat", err)
+	}
+	if !os.SameFile(open, named) {
+		return nil
+	}
+	return l.pathError("remove", os.Remove(l.filename))
+}
+
+// LockWithContext tries to lock the lock until the context is done.  If the
+// context is done first, this method will return the context's error, or the
+// cause it was canceled with, if any.
+func (l *Lock) LockWithContext(ctx context.Context) error {
+	if done, err := l.reenter(); done {
+		return err
+	}
+	// Poll, backing off like cmd/go's lockedfile does, as there's no way to
+	// wait for an exclusive-use file to be closed.
+	start := l.startWait()
+	l.logf("waiting")
+	delay := time.Millisecond
+	counted := false
+	for {
+		err := l.open(start)
+		if err != ErrLocked {
+			return err
+		}
+		if !counted {
+			l.contended()
+			counted = true
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			l.logf("gave up waiting: %v", contextError(ctx))
+			return contextError(ctx)
+		case <-timer.C:
+		}
+		if delay < 500*time.Millisecond {
+			delay *= 2
+		}
+	}
+}
+
+// open opens the lock file for exclusive use, which locks it, returning
+// ErrLocked if someone else has it open.  start is when the attempt to
+// acquire the lock began.
+func (l *Lock) open(start time.Time) error {
+	if err := l.mkdirAll(); err != nil {
+		return l.pathError("open", err)
+	}
+	// A file created by some other program might not be exclusive-use, in
+	// which case opening it wouldn't lock anything, so make sure it is.
+	if fi, err := os.Stat(l.filename); err == nil {
+		if fi.IsDir() {
+			return l.pathError("open", ErrNotRegularFile)
+		}
+		if fi.Mode()&os.ModeExclusive == 0 {
+			if err := os.Chmod(l.filename, fi.Mode()|os.ModeExclusive); err != nil {
+				return l.pathError("open", err)
+			}
+		}
+	} else if !os.IsNotExist(err) {
+		return l.pathError("open", err)
+	} else if l.opts.noCreate {
+		return l.pathError("open", ErrNotExist)
+	}
+	f, err := os.OpenFile(l.filename, os.O_RDWR|os.O_CREATE, os.ModeExclusive|l.opts.mode.Perm())
+	if err != nil {
+		if isLocked(err) {
+			return ErrLocked
+		}
+		l.logf("open failed: %v", err)
+		return l.pathError("open", err)
+	}
+	l.file = f
+	l.acquired(start)
+	return nil
+}
+
+// lockedErrStrings are the errors that file servers return on opening an
+// exclusive-use file that is already open.
+var lockedErrStrings = [...]string{
+	"file is locked",                  // cwfs, kfs
+	"exclusive lock",                  // fossil
+	"exclusive use file already open", // ramfs
+}
+
+// isLocked reports whether err is from opening an exclusive-use file that is
+// already open.
+func isLocked(err error) bool {
+	s := err.Error()
+	for _, frag := range lockedErrStrings {
+		if strings.Contains(s, frag) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeRecord replaces the content of the lock file with record.
+func (l *Lock) writeRecord(record []byte) error {
+	if err := l.file.Truncate(0); err != nil {
+		return err
+	}
+	_, err := l.file.WriteAt(record, 0)
+	return err
+}
+
+// readRecord returns the content of the lock file, read through the file
+// this instance holds open, if any.  Nobody else can read it while the lock is
+// held, since only the holder can open it.
+func (l *Lock) readRecord() ([]byte, error) {
+	if l.file != nil {
+		info, err := l.file.Stat()
+		if err != nil {
+			return nil, err
+		}
+		record := make([]byte, info.Size())
+		n, err := l.file.ReadAt(record, 0)
+		if err == io.EOF {
+			err = nil
+		}
+		return record[:n], err
+	}
+	data, err := ioutil.ReadFile(l.filename)
+	if err != nil && isLocked(err) {
+		return nil, ErrUnsupported
+	}
+	return data, err
+}
@@ -4,11 +4,16 @@
 package fslock_test
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"runtime"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -218,6 +223,1740 @@ func (s *fslockSuite) TestLockWithTimeout(c *gc.C) {
 	}
 }
 
+func (s *fslockSuite) TestUnlockedWithContext(c *gc.C) {
+	lock := fslock.New(filepath.Join(c.MkDir(), "testing"))
+
+	err := lock.LockWithContext(context.Background())
+	c.Assert(err, gc.IsNil)
+	lock.Unlock()
+}
+
+func (s *fslockSuite) TestLockWithContextCanceled(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	defer lock.Unlock()
+
+	kill := make(chan struct{})
+
+	// this will block until the other process has the lock.
+	procDone := LockFromAnotherProc(c, path, kill)
+
+	defer func() {
+		close(kill)
+		// now wait for the other process to exit so the file will be unlocked.
+		select {
+		case <-procDone:
+		case <-time.After(time.Second):
+		}
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	result := make(chan error)
+	go func() {
+		result <- lock.LockWithContext(ctx)
+	}()
+
+	// Waiting for something not to happen is inherently hard...
+	select {
+	case err := <-result:
+		c.Fatalf("lock returned before being canceled: %v", err)
+	case <-time.After(shortWait):
+		// all good.
+	}
+
+	cancel()
+	select {
+	case err := <-result:
+		c.Assert(err, gc.Equals, context.Canceled)
+	case <-time.After(shortWait * 2):
+		c.Fatalf("lock took too long to notice cancellation")
+	}
+}
+
+func (s *fslockSuite) TestTryLockWithTimeout(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	holder := fslock.New(path)
+	err := holder.Lock()
+	c.Assert(err, gc.IsNil)
+
+	lock := fslock.New(path)
+	start := time.Now()
+	err = lock.TryLockWithTimeout(shortWait*3, shortWait)
+	c.Assert(err, gc.Equals, fslock.ErrTimeout)
+	c.Assert(time.Since(start) >= shortWait*3, gc.Equals, true)
+
+	// Release the lock part way through the wait and it should be picked up.
+	released := make(chan struct{})
+	go func() {
+		defer close(released)
+		time.Sleep(shortWait * 2)
+		holder.Unlock()
+	}()
+	err = lock.TryLockWithTimeout(longWait, shortWait)
+	c.Assert(err, gc.IsNil)
+	lock.Unlock()
+	<-released
+
+	// No interval polls every millisecond rather than spinning.
+	c.Assert(holder.Lock(), gc.IsNil)
+	polls := lock.Stats().Contended
+	c.Assert(lock.TryLockWithTimeout(shortWait, 0), gc.Equals, fslock.ErrTimeout)
+	c.Assert(lock.Stats().Contended-polls <= 12, gc.Equals, true)
+	c.Assert(holder.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestIsLocked(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+
+	// A lock file that doesn't exist yet isn't locked, and isn't created.
+	locked, err := lock.IsLocked()
+	c.Assert(err, gc.IsNil)
+	c.Assert(locked, gc.Equals, false)
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+
+	err = lock.Lock()
+	c.Assert(err, gc.IsNil)
+
+	// Probing doesn't disturb the lock we already hold.
+	for i := 0; i < 2; i++ {
+		locked, err = fslock.New(path).IsLocked()
+		c.Assert(err, gc.IsNil)
+		c.Assert(locked, gc.Equals, true)
+	}
+	locked, err = lock.IsLocked()
+	c.Assert(err, gc.IsNil)
+	c.Assert(locked, gc.Equals, true)
+
+	err = lock.Unlock()
+	c.Assert(err, gc.IsNil)
+	locked, err = lock.IsLocked()
+	c.Assert(err, gc.IsNil)
+	c.Assert(locked, gc.Equals, false)
+}
+
+func (s *fslockSuite) TestHeld(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	c.Assert(lock.Held(), gc.Equals, false)
+
+	err := lock.Lock()
+	c.Assert(err, gc.IsNil)
+	c.Assert(lock.Held(), gc.Equals, true)
+
+	// Held is about this instance only.
+	other := fslock.New(path)
+	c.Assert(other.Held(), gc.Equals, false)
+	err = other.TryLock()
+	c.Assert(err, gc.Equals, fslock.ErrLocked)
+	c.Assert(other.Held(), gc.Equals, false)
+
+	err = lock.Unlock()
+	c.Assert(err, gc.IsNil)
+	c.Assert(lock.Held(), gc.Equals, false)
+
+	err = other.LockWithTimeout(shortWait)
+	c.Assert(err, gc.IsNil)
+	c.Assert(other.Held(), gc.Equals, true)
+	other.Unlock()
+}
+
+func (s *fslockSuite) TestLockWithPID(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	err := os.WriteFile(path, []byte("some much longer stale content\n"), 0600)
+	c.Assert(err, gc.IsNil)
+
+	lock := fslock.New(path)
+	err = lock.LockWithPID()
+	c.Assert(err, gc.IsNil)
+	c.Assert(lock.Held(), gc.Equals, true)
+	err = lock.Unlock()
+	c.Assert(err, gc.IsNil)
+
+	data, err := os.ReadFile(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(strings.TrimSpace(string(data)), gc.Equals, strconv.Itoa(os.Getpid()))
+}
+
+func (s *fslockSuite) TestHolderPID(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+
+	pid, err := lock.HolderPID()
+	c.Assert(err, gc.IsNil)
+	c.Assert(pid, gc.Equals, 0)
+
+	err = lock.Lock()
+	c.Assert(err, gc.IsNil)
+	pid, err = fslock.New(path).HolderPID()
+	c.Assert(err, gc.IsNil)
+	c.Assert(pid, gc.Equals, 0)
+	lock.Unlock()
+
+	err = lock.LockWithPID()
+	c.Assert(err, gc.IsNil)
+	defer lock.Unlock()
+	pid, err = fslock.New(path).HolderPID()
+	c.Assert(err, gc.IsNil)
+	c.Assert(pid, gc.Equals, os.Getpid())
+
+	// A PID without its trailing newline is still being written.
+	partial := filepath.Join(c.MkDir(), "partial")
+	err = os.WriteFile(partial, []byte("123"), 0600)
+	c.Assert(err, gc.IsNil)
+	_, err = fslock.New(partial).HolderPID()
+	c.Assert(err, gc.Equals, fslock.ErrIncompletePID)
+
+	// Anything else that isn't a PID is reported with the file it is in.
+	garbage := filepath.Join(c.MkDir(), "garbage")
+	err = os.WriteFile(garbage, []byte("not a pid\n"), 0600)
+	c.Assert(err, gc.IsNil)
+	_, err = fslock.New(garbage).HolderPID()
+	c.Assert(err, gc.ErrorMatches, `fslock: parse ".*garbage": .*invalid syntax`)
+}
+
+func (s *fslockSuite) TestWhoHolds(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+
+	pid, err := fslock.New(path).WhoHolds()
+	c.Assert(err, gc.IsNil)
+	c.Assert(pid, gc.Equals, 0)
+
+	err = lock.LockWithPID()
+	c.Assert(err, gc.IsNil)
+	pid, err = fslock.New(path).WhoHolds()
+	c.Assert(err, gc.IsNil)
+	c.Assert(pid, gc.Equals, os.Getpid())
+
+	// The PID stays in the file once the lock is released, but nobody holds
+	// the lock any more.
+	err = lock.Unlock()
+	c.Assert(err, gc.IsNil)
+	pid, err = fslock.New(path).HolderPID()
+	c.Assert(err, gc.IsNil)
+	c.Assert(pid, gc.Equals, os.Getpid())
+	pid, err = fslock.New(path).WhoHolds()
+	c.Assert(err, gc.IsNil)
+	c.Assert(pid, gc.Equals, 0)
+}
+
+func (s *fslockSuite) TestHolder(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+
+	holder, err := fslock.New(path).Holder()
+	c.Assert(err, gc.IsNil)
+	c.Assert(holder, gc.Equals, fslock.Holder{})
+
+	before := time.Now().Add(-time.Second)
+	err = lock.LockWithHolder()
+	c.Assert(err, gc.IsNil)
+	holder, err = fslock.New(path).Holder()
+	c.Assert(err, gc.IsNil)
+	host, err := os.Hostname()
+	c.Assert(err, gc.IsNil)
+	c.Assert(holder.Host, gc.Equals, host)
+	c.Assert(holder.PID, gc.Equals, os.Getpid())
+	c.Assert(holder.Since.After(before), gc.Equals, true)
+	c.Assert(holder.Since.After(time.Now()), gc.Equals, false)
+
+	// Nothing but the record is left next to the lock file.
+	entries, err := os.ReadDir(filepath.Dir(path))
+	c.Assert(err, gc.IsNil)
+	c.Assert(entries, gc.HasLen, 2)
+
+	err = lock.Unlock()
+	c.Assert(err, gc.IsNil)
+	holder, err = fslock.New(path).Holder()
+	c.Assert(err, gc.IsNil)
+	c.Assert(holder, gc.Equals, fslock.Holder{})
+}
+
+func (s *fslockSuite) TestLockAlreadyHeld(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	c.Assert(lock.Lock(), gc.IsNil)
+
+	c.Assert(lock.Lock(), gc.Equals, fslock.ErrAlreadyHeld)
+	c.Assert(lock.TryLock(), gc.Equals, fslock.ErrAlreadyHeld)
+	c.Assert(lock.RLock(), gc.Equals, fslock.ErrAlreadyHeld)
+	c.Assert(lock.LockWithTimeout(shortWait), gc.Equals, fslock.ErrAlreadyHeld)
+	c.Assert(lock.Held(), gc.Equals, true)
+
+	// A single Unlock still releases the lock.
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(fslock.New(path).TryLock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestCreateLock(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	c.Assert(lock.CreateLock(), gc.IsNil)
+	c.Assert(lock.Held(), gc.Equals, true)
+	c.Assert(lock.CreateLock(), gc.Equals, fslock.ErrAlreadyHeld)
+	pid, err := lock.HolderPID()
+	c.Assert(err, gc.IsNil)
+	c.Assert(pid, gc.Equals, os.Getpid())
+
+	// The file existing is enough to fail, whether or not it's locked.
+	other := fslock.New(path)
+	c.Assert(other.CreateLock(), gc.Equals, fslock.ErrExists)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(other.CreateLock(), gc.Equals, fslock.ErrExists)
+	c.Assert(other.Held(), gc.Equals, false)
+
+	// Until the file is removed.
+	c.Assert(lock.TryLock(), gc.IsNil)
+	c.Assert(lock.UnlockAndRemove(), gc.IsNil)
+	c.Assert(other.CreateLock(), gc.IsNil)
+	c.Assert(other.UnlockAndRemove(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestPath(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	c.Assert(fslock.New(path).Path(), gc.Equals, path)
+}
+
+func (s *fslockSuite) TestClone(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path, fslock.WithReentrant())
+	c.Assert(lock.Lock(), gc.IsNil)
+
+	clone := lock.Clone()
+	c.Assert(clone.String(), gc.Equals, "fslock("+path+", held=false)")
+	c.Assert(clone.TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(lock.Unlock(), gc.IsNil)
+
+	// The options come along too.
+	c.Assert(clone.Lock(), gc.IsNil)
+	c.Assert(clone.Lock(), gc.IsNil)
+	c.Assert(clone.Unlock(), gc.IsNil)
+	c.Assert(lock.TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(clone.Unlock(), gc.IsNil)
+	c.Assert(lock.TryLock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestLockN(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+
+	lock := fslock.New(path)
+	start := time.Now()
+	c.Assert(lock.LockN(3, shortWait), gc.Equals, fslock.ErrLocked)
+	c.Assert(time.Since(start) >= 2*shortWait, gc.Equals, true)
+	c.Assert(lock.LockN(0, longWait), gc.Equals, fslock.ErrLocked)
+
+	// Release the lock part way through the attempts and it should be
+	// picked up.
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(shortWait * 2)
+		holder.Unlock()
+		close(released)
+	}()
+	c.Assert(lock.LockN(100, shortWait), gc.IsNil)
+	<-released
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestWaitForUnlock(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+
+	// A free lock, or one whose file doesn't exist yet, doesn't wait.
+	c.Assert(lock.WaitForUnlock(context.Background()), gc.IsNil)
+
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+	c.Assert(holder.WaitForUnlock(context.Background()), gc.Equals, fslock.ErrAlreadyHeld)
+	ctx, cancel := context.WithTimeout(context.Background(), shortWait)
+	defer cancel()
+	c.Assert(lock.WaitForUnlock(ctx), gc.Equals, context.DeadlineExceeded)
+
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(shortWait)
+		holder.Unlock()
+		close(released)
+	}()
+	c.Assert(lock.WaitForUnlock(context.Background()), gc.IsNil)
+	<-released
+	c.Assert(holder.Held(), gc.Equals, false)
+	c.Assert(lock.Held(), gc.Equals, false)
+}
+
+func (s *fslockSuite) TestNewWithContext(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	ctx, cancel := context.WithCancel(context.Background())
+	lock := fslock.NewWithContext(ctx, path)
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+	c.Assert(lock.LockWithTimeout(shortWait), gc.Equals, fslock.ErrTimeout)
+
+	go func() {
+		time.Sleep(shortWait)
+		cancel()
+	}()
+	c.Assert(lock.Lock(), gc.Equals, context.Canceled)
+	c.Assert(lock.LockWithTimeout(longWait), gc.Equals, context.Canceled)
+	c.Assert(lock.LockWithTimeout(-1), gc.Equals, context.Canceled)
+
+	// A context given explicitly is used instead.
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(shortWait)
+		holder.Unlock()
+		close(released)
+	}()
+	c.Assert(lock.LockWithContext(context.Background()), gc.IsNil)
+	<-released
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestTouch(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	c.Assert(lock.Touch(), gc.IsNil)
+	_, err := os.Stat(path)
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+
+	c.Assert(lock.Lock(), gc.IsNil)
+	old := time.Now().Add(-time.Hour)
+	c.Assert(os.Chtimes(path, old, old), gc.IsNil)
+	c.Assert(lock.Touch(), gc.IsNil)
+	fi, err := os.Stat(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(time.Since(fi.ModTime()) < time.Minute, gc.Equals, true)
+
+	// Once unlocked, the file is left alone.
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(os.Chtimes(path, old, old), gc.IsNil)
+	c.Assert(lock.Touch(), gc.IsNil)
+	fi, err = os.Stat(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fi.ModTime().Equal(old), gc.Equals, true)
+}
+
+func (s *fslockSuite) TestLockLease(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lease, err := fslock.New(path).LockLease(context.Background(), longWait, shortWait)
+	c.Assert(err, gc.IsNil)
+	c.Assert(fslock.New(path).TryLock(), gc.Equals, fslock.ErrLocked)
+
+	// The heartbeat keeps the file fresh.
+	old := time.Now().Add(-time.Hour)
+	c.Assert(os.Chtimes(path, old, old), gc.IsNil)
+	time.Sleep(shortWait * 3)
+	fi, err := os.Stat(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(time.Since(fi.ModTime()) < time.Minute, gc.Equals, true)
+
+	c.Assert(lease.Close(), gc.IsNil)
+	c.Assert(lease.Close(), gc.IsNil)
+
+	// Closes racing each other don't close the heartbeat's channel twice.
+	lease, err = fslock.New(path).LockLease(context.Background(), longWait, shortWait)
+	c.Assert(err, gc.IsNil)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Check(lease.Close(), gc.IsNil)
+		}()
+	}
+	wg.Wait()
+	lock := fslock.New(path)
+	c.Assert(lock.TryLock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestBreakExpiredLease(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	breaker := fslock.New(path)
+
+	// Nothing to break without a lock file, or while it's free.
+	broken, err := breaker.BreakExpiredLease(shortWait)
+	c.Assert(err, gc.IsNil)
+	c.Assert(broken, gc.Equals, false)
+	lock := fslock.New(path)
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	old := time.Now().Add(-time.Hour)
+	c.Assert(os.Chtimes(path, old, old), gc.IsNil)
+	broken, err = breaker.BreakExpiredLease(shortWait)
+	c.Assert(err, gc.IsNil)
+	c.Assert(broken, gc.Equals, false)
+
+	// Nor while the lease is being renewed.
+	lease, err := lock.LockLease(context.Background(), time.Hour, longWait)
+	c.Assert(err, gc.IsNil)
+	broken, err = breaker.BreakExpiredLease(time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(broken, gc.Equals, false)
+
+	// Once it has expired, the lock can be taken on a new file, and the
+	// old holder finds out when it next renews.
+	c.Assert(os.Chtimes(path, old, old), gc.IsNil)
+	broken, err = breaker.BreakExpiredLease(time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(broken, gc.Equals, true)
+	c.Assert(breaker.TryLock(), gc.IsNil)
+	time.Sleep(longWait * 2)
+	c.Assert(lease.Close(), gc.Equals, fslock.ErrStale)
+	c.Assert(fslock.New(path).TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(breaker.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestRelockAfterUnlock(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	other := fslock.New(path)
+	for i, lockWith := range []func() error{
+		lock.Lock,
+		lock.TryLock,
+		func() error { return lock.LockWithTimeout(shortWait) },
+		func() error { return lock.LockWithContext(context.Background()) },
+		lock.Lock,
+		lock.TryLock,
+	} {
+		c.Logf("cycle %d", i)
+		c.Assert(lockWith(), gc.IsNil)
+		c.Assert(lock.Held(), gc.Equals, true)
+		c.Assert(other.TryLock(), gc.Equals, fslock.ErrLocked)
+		c.Assert(lock.Unlock(), gc.IsNil)
+		c.Assert(lock.Held(), gc.Equals, false)
+		c.Assert(other.TryLock(), gc.IsNil)
+		c.Assert(other.Unlock(), gc.IsNil)
+	}
+}
+
+func (s *fslockSuite) TestNewChecked(c *gc.C) {
+	dir := c.MkDir()
+	_, err := fslock.NewChecked("")
+	c.Assert(err, gc.Equals, fslock.ErrInvalidPath)
+
+	missing := filepath.Join(dir, "missing", "testing")
+	_, err = fslock.NewChecked(missing)
+	c.Assert(errors.Is(err, os.ErrNotExist), gc.Equals, true)
+
+	file := filepath.Join(dir, "file")
+	c.Assert(os.WriteFile(file, nil, 0600), gc.IsNil)
+	_, err = fslock.NewChecked(filepath.Join(file, "testing"))
+	c.Assert(errors.Is(err, fslock.ErrInvalidPath), gc.Equals, true)
+
+	lock, err := fslock.NewChecked(missing, fslock.WithMkdirAll(0700))
+	c.Assert(err, gc.IsNil)
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+
+	lock, err = fslock.NewChecked(filepath.Join(dir, "testing"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(lock.Path(), gc.Equals, filepath.Join(dir, "testing"))
+}
+
+func (s *fslockSuite) TestWithNoCreate(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path, fslock.WithNoCreate())
+	err := lock.Lock()
+	c.Assert(errors.Is(err, fslock.ErrNotExist), gc.Equals, true)
+	c.Assert(errors.Is(err, os.ErrNotExist), gc.Equals, true)
+	c.Assert(lock.TryLock(), gc.ErrorMatches, `fslock: open ".*": lock file does not exist`)
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+
+	c.Assert(os.WriteFile(path, nil, 0600), gc.IsNil)
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestStats(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	c.Assert(lock.Stats(), gc.Equals, fslock.LockStats{})
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	stats := lock.Stats()
+	c.Assert(stats.Acquires, gc.Equals, int64(1))
+	c.Assert(stats.Contended, gc.Equals, int64(0))
+
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+	c.Assert(lock.TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(lock.LockWithTimeout(shortWait), gc.Equals, fslock.ErrTimeout)
+	c.Assert(lock.Stats().Contended, gc.Equals, int64(2))
+
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(shortWait * 2)
+		holder.Unlock()
+		close(released)
+	}()
+	c.Assert(lock.Lock(), gc.IsNil)
+	<-released
+	c.Assert(lock.Unlock(), gc.IsNil)
+	stats = lock.Stats()
+	c.Assert(stats.Acquires, gc.Equals, int64(2))
+	c.Assert(stats.Contended, gc.Equals, int64(3))
+	c.Assert(stats.MaxWait >= shortWait, gc.Equals, true)
+	c.Assert(stats.TotalWait >= stats.MaxWait, gc.Equals, true)
+	c.Assert(holder.Stats().Acquires, gc.Equals, int64(1))
+}
+
+func (s *fslockSuite) TestWithStrictUnlock(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	c.Assert(fslock.New(path).Unlock(), gc.IsNil)
+
+	lock := fslock.New(path, fslock.WithStrictUnlock())
+	c.Assert(lock.Unlock(), gc.Equals, fslock.ErrNotHeld)
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.Equals, fslock.ErrNotHeld)
+
+	// A failed attempt leaves nothing to unlock.
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+	c.Assert(lock.TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(lock.Unlock(), gc.Equals, fslock.ErrNotHeld)
+	c.Assert(holder.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestQueue(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+
+	q := fslock.NewQueue(fslock.New(path))
+	var mu sync.Mutex
+	var order []int
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c.Check(q.Do(func() error {
+				mu.Lock()
+				order = append(order, i)
+				mu.Unlock()
+				return nil
+			}), gc.IsNil)
+		}(i)
+		// Let each worker queue up before the next.
+		time.Sleep(shortWait)
+	}
+	c.Assert(holder.Unlock(), gc.IsNil)
+	wg.Wait()
+	c.Assert(order, gc.DeepEquals, []int{0, 1, 2, 3, 4})
+
+	// Errors are returned, and a panic doesn't stall the queue.
+	errFailed := errors.New("failed")
+	c.Assert(q.Do(func() error { return errFailed }), gc.Equals, errFailed)
+	c.Assert(func() {
+		q.Do(func() error { panic("oops") })
+	}, gc.PanicMatches, "oops")
+	c.Assert(q.Do(func() error { return nil }), gc.IsNil)
+	other := fslock.New(path)
+	c.Assert(other.TryLock(), gc.IsNil)
+	c.Assert(other.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestDoubleUnlock(c *gc.C) {
+	dir := c.MkDir()
+	lock := fslock.New(filepath.Join(dir, "testing"))
+	err := lock.Lock()
+	c.Assert(err, gc.IsNil)
+	err = lock.Unlock()
+	c.Assert(err, gc.IsNil)
+
+	// This is likely to be given the descriptor the lock just closed, which
+	// a second Unlock must leave alone.
+	f, err := os.Create(filepath.Join(dir, "other"))
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+
+	err = lock.Unlock()
+	c.Assert(err, gc.IsNil)
+	_, err = f.Write([]byte("still open"))
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *fslockSuite) TestUnlockAfterFailedLock(c *gc.C) {
+	lock := fslock.New(filepath.Join(c.MkDir(), "missing", "testing"))
+	err := lock.Lock()
+	c.Assert(err, gc.NotNil)
+	err = lock.Unlock()
+	c.Assert(err, gc.IsNil)
+	err = lock.Unlock()
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *fslockSuite) TestString(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	c.Assert(lock.String(), gc.Equals, "fslock("+path+", held=false)")
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(fmt.Sprintf("%v", lock), gc.Equals, "fslock("+path+", held=true)")
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestReentrant(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path, fslock.WithReentrant())
+	other := fslock.New(path)
+
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.TryLock(), gc.IsNil)
+	c.Assert(lock.LockWithTimeout(shortWait), gc.IsNil)
+
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(lock.Held(), gc.Equals, true)
+	c.Assert(other.TryLock(), gc.Equals, fslock.ErrLocked)
+
+	// The balancing Unlock releases the lock.
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(lock.Held(), gc.Equals, false)
+	c.Assert(other.TryLock(), gc.IsNil)
+	c.Assert(lock.TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(other.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestAcquireRelease(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	other := fslock.New(path)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			c.Check(lock.Acquire(), gc.IsNil)
+		}()
+	}
+	wg.Wait()
+	c.Assert(lock.Held(), gc.Equals, true)
+
+	for i := 0; i < 4; i++ {
+		c.Assert(lock.Release(), gc.IsNil)
+		c.Assert(other.TryLock(), gc.Equals, fslock.ErrLocked)
+	}
+	c.Assert(lock.Release(), gc.IsNil)
+	c.Assert(lock.Held(), gc.Equals, false)
+	c.Assert(lock.Release(), gc.IsNil)
+
+	// A failed Acquire leaves no reference behind.
+	c.Assert(other.TryLock(), gc.IsNil)
+	broken := fslock.New(filepath.Join(c.MkDir(), "missing", "testing"))
+	c.Assert(broken.Acquire(), gc.NotNil)
+	c.Assert(broken.Release(), gc.IsNil)
+	c.Assert(other.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestLockWithRetry(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+
+	lock := fslock.New(path)
+	ctx, cancel := context.WithTimeout(context.Background(), shortWait*3)
+	defer cancel()
+	err := lock.LockWithRetry(ctx, time.Millisecond, shortWait)
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(shortWait * 2)
+		holder.Unlock()
+		close(released)
+	}()
+	err = lock.LockWithRetry(context.Background(), time.Millisecond, shortWait)
+	c.Assert(err, gc.IsNil)
+	<-released
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestLockFair(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+
+	lock := fslock.New(path)
+	ctx, cancel := context.WithTimeout(context.Background(), shortWait*3)
+	defer cancel()
+	err := lock.LockFair(ctx)
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+	c.Assert(holder.Unlock(), gc.IsNil)
+
+	// A free lock is taken at once, before the context is looked at, unless
+	// this instance has only just unlocked it.
+	done, cancelDone := context.WithCancel(context.Background())
+	cancelDone()
+	c.Assert(lock.LockFair(done), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(lock.LockFair(done), gc.Equals, context.Canceled)
+
+	// Waiters that keep taking the lock back all get a turn.
+	const waiters = 4
+	var wg sync.WaitGroup
+	got := make([]int, waiters)
+	for i := range got {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			lock := fslock.New(path)
+			for j := 0; j < 5; j++ {
+				c.Check(lock.LockFair(context.Background()), gc.IsNil)
+				got[i]++
+				time.Sleep(time.Millisecond)
+				c.Check(lock.Unlock(), gc.IsNil)
+			}
+		}(i)
+	}
+	wg.Wait()
+	c.Assert(got, gc.DeepEquals, []int{5, 5, 5, 5})
+}
+
+func (s *fslockSuite) TestTryLockContextOnce(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+
+	lock := fslock.New(path)
+	ctx, cancel := context.WithTimeout(context.Background(), longWait)
+	defer cancel()
+	start := time.Now()
+	c.Assert(lock.TryLockContextOnce(ctx), gc.Equals, fslock.ErrLocked)
+	c.Assert(time.Since(start) < longWait, gc.Equals, true)
+	c.Assert(holder.Unlock(), gc.IsNil)
+
+	// A context that is already done still gets its attempt.
+	cancel()
+	c.Assert(lock.TryLockContextOnce(ctx), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestLockPoll(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+
+	lock := fslock.New(path)
+	ctx, cancel := context.WithTimeout(context.Background(), shortWait*3)
+	defer cancel()
+	err := lock.LockPoll(ctx, time.Millisecond)
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(shortWait * 2)
+		holder.Unlock()
+		close(released)
+	}()
+	err = lock.LockPoll(context.Background(), time.Millisecond)
+	c.Assert(err, gc.IsNil)
+	<-released
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestTryLockRange(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	defer lock.Unlock()
+
+	kill := make(chan struct{})
+
+	// Record locks belong to the process, so the contending lock has to be
+	// taken by another one.
+	procDone := LockFromAnotherProc(c, path, kill, "FSLOCK_TEST_HELPER_RANGE=0:10")
+
+	defer func() {
+		close(kill)
+		// now wait for the other process to exit so the file will be unlocked.
+		select {
+		case <-procDone:
+		case <-time.After(time.Second):
+		}
+	}()
+	// Make sure the other process has gone from creating the file to locking
+	// the range.
+	time.Sleep(shortWait)
+
+	c.Assert(lock.TryLockRange(0, 10, true), gc.Equals, fslock.ErrLocked)
+	c.Assert(lock.TryLockRange(5, 10, false), gc.Equals, fslock.ErrLocked)
+	c.Assert(lock.TryLockRange(10, 10, true), gc.IsNil)
+	c.Assert(lock.UnlockRange(10, 10), gc.IsNil)
+}
+
+func (s *fslockSuite) TestOFDBackend(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path, fslock.WithBackend(fslock.OFD))
+	other := fslock.New(path, fslock.WithBackend(fslock.OFD))
+
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(other.TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(other.TryRLock(), gc.Equals, fslock.ErrLocked)
+	locked, err := other.IsLocked()
+	c.Assert(err, gc.IsNil)
+	c.Assert(locked, gc.Equals, true)
+
+	// Closing an unrelated descriptor for the file leaves the lock alone.
+	f, err := os.Open(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(f.Close(), gc.IsNil)
+	c.Assert(other.TryLock(), gc.Equals, fslock.ErrLocked)
+
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(other.RLock(), gc.IsNil)
+	c.Assert(lock.TryRLock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(other.Unlock(), gc.IsNil)
+}
+
+// TestFcntlBackend can be run against an NFS mount, where the Fcntl backend
+// matters most, by setting FSLOCK_TEST_NFS_DIR to a directory on the mount:
+//
+//	FSLOCK_TEST_NFS_DIR=/mnt/nfs/tmp go test -check.f TestFcntlBackend
+//
+// For a real test of the lock manager, run it on two clients at once.
+func (s *fslockSuite) TestFcntlBackend(c *gc.C) {
+	dir := os.Getenv("FSLOCK_TEST_NFS_DIR")
+	if dir == "" {
+		dir = c.MkDir()
+	}
+	path := filepath.Join(dir, fmt.Sprintf("fslock-fcntl-%d", os.Getpid()))
+	defer os.Remove(path)
+	lock := fslock.New(path, fslock.WithBackend(fslock.Fcntl))
+
+	kill := make(chan struct{})
+
+	// Record locks belong to the process, so the contending lock has to be
+	// taken by another one.
+	procDone := LockFromAnotherProc(c, path, kill, "FSLOCK_TEST_HELPER_BACKEND=fcntl")
+
+	defer func() {
+		close(kill)
+		// now wait for the other process to exit so the file will be unlocked.
+		select {
+		case <-procDone:
+		case <-time.After(time.Second):
+		}
+	}()
+	// Make sure the other process has gone from creating the file to locking
+	// it.
+	time.Sleep(shortWait)
+
+	c.Assert(lock.TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(lock.TryRLock(), gc.Equals, fslock.ErrLocked)
+	locked, err := lock.IsLocked()
+	c.Assert(err, gc.IsNil)
+	c.Assert(locked, gc.Equals, true)
+
+	// Once the other process is gone, the lock is ours.
+	<-procDone
+	c.Assert(lock.TryLock(), gc.IsNil)
+	locked, err = lock.IsLocked()
+	c.Assert(err, gc.IsNil)
+	c.Assert(locked, gc.Equals, true)
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestLogger(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "lockfile")
+	var logged []string
+	logf := func(format string, args ...interface{}) {
+		logged = append(logged, fmt.Sprintf(format, args...))
+	}
+	lock := fslock.New(path, fslock.WithLogger(logf))
+	other := fslock.New(path)
+
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(other.Lock(), gc.IsNil)
+	c.Assert(lock.TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(other.Unlock(), gc.IsNil)
+
+	// Which of the other messages appear depends on the platform.
+	var transitions []string
+	for _, msg := range logged {
+		c.Assert(strings.HasPrefix(msg, "fslock: "+path+": "), gc.Equals, true)
+		switch msg = msg[len("fslock: "+path+": "):]; msg {
+		case "acquired", "released", "already locked":
+			transitions = append(transitions, msg)
+		}
+	}
+	c.Assert(transitions, gc.DeepEquals, []string{"acquired", "released", "already locked"})
+}
+
+func (s *fslockSuite) TestLockWithTimeoutDoesNotLeakGoroutines(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "lockfile")
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+	defer holder.Unlock()
+
+	baseline := runtime.NumGoroutine()
+	lock := fslock.New(path)
+	for i := 0; i < 20; i++ {
+		c.Assert(lock.LockWithTimeout(time.Millisecond), gc.Equals, fslock.ErrTimeout)
+	}
+	// Goroutines left over from earlier tests may still be exiting, so
+	// only insist that there are no more than there were.
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > baseline; {
+		c.Assert(time.Now().Before(deadline), gc.Equals, true, gc.Commentf("%d goroutines, want %d", runtime.NumGoroutine(), baseline))
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func (s *fslockSuite) TestLockWithContextTimeoutLeavesUnlocked(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "lockfile")
+	lock := fslock.New(path)
+	other := fslock.New(path)
+	for i := 0; i < 20; i++ {
+		// Release the lock around when the wait gives up, so that some
+		// attempts race the timeout.
+		c.Assert(other.Lock(), gc.IsNil)
+		released := make(chan struct{})
+		go func() {
+			time.Sleep(5 * time.Millisecond)
+			other.Unlock()
+			close(released)
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+		err := lock.LockWithContext(ctx)
+		cancel()
+		<-released
+		if err == nil {
+			c.Assert(lock.Unlock(), gc.IsNil)
+			continue
+		}
+		c.Assert(err, gc.Equals, context.DeadlineExceeded)
+		c.Assert(lock.Held(), gc.Equals, false)
+		c.Assert(lock.Unlock(), gc.IsNil)
+		// Nothing is left holding the lock on the instance's behalf.
+		c.Assert(other.TryLock(), gc.IsNil)
+		c.Assert(other.Unlock(), gc.IsNil)
+	}
+}
+
+func (s *fslockSuite) TestHooks(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "lockfile")
+	var waits int
+	var waited, held []time.Duration
+	lock := fslock.New(path, fslock.WithHooks(fslock.Hooks{
+		OnWaitStart: func() { waits++ },
+		OnAcquired:  func(d time.Duration) { waited = append(waited, d) },
+		OnReleased:  func(d time.Duration) { held = append(held, d) },
+	}))
+	other := fslock.New(path)
+
+	c.Assert(other.Lock(), gc.IsNil)
+	c.Assert(lock.TryLock(), gc.Equals, fslock.ErrLocked)
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(shortWait)
+		other.Unlock()
+		close(released)
+	}()
+	c.Assert(lock.LockWithTimeout(longWait), gc.IsNil)
+	<-released
+	time.Sleep(shortWait)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+
+	c.Assert(waits, gc.Equals, 2)
+	c.Assert(waited, gc.HasLen, 1)
+	c.Assert(waited[0] >= shortWait/2, gc.Equals, true, gc.Commentf("waited %v", waited[0]))
+	c.Assert(held, gc.HasLen, 1)
+	c.Assert(held[0] >= shortWait, gc.Equals, true, gc.Commentf("held %v", held[0]))
+}
+
+func (s *fslockSuite) TestErrorsWrapped(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "missing", "lockfile")
+	lock := fslock.New(path)
+	err := lock.Lock()
+	c.Assert(err, gc.ErrorMatches, `fslock: open ".*lockfile": .*`)
+	c.Assert(errors.Is(err, os.ErrNotExist), gc.Equals, true)
+}
+
+func (s *fslockSuite) TestUnlockAndRemove(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "lockfile")
+	lock := fslock.New(path)
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.UnlockAndRemove(), gc.IsNil)
+	c.Assert(lock.Held(), gc.Equals, false)
+	_, err := os.Stat(path)
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+
+	// An unlocked lock has nothing to remove.
+	c.Assert(lock.UnlockAndRemove(), gc.IsNil)
+
+	// The lock can be taken again, which recreates the file.
+	other := fslock.New(path)
+	c.Assert(other.TryLock(), gc.IsNil)
+	_, err = os.Stat(path)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lock.TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(other.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestBreakStaleLock(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "lockfile")
+	lock := fslock.New(path)
+
+	// Nothing to break without a recorded PID.
+	broken, err := lock.BreakStaleLock()
+	c.Assert(err, gc.IsNil)
+	c.Assert(broken, gc.Equals, false)
+
+	// Nor while the recorded holder is alive, even once it has unlocked.
+	holder := fslock.New(path)
+	c.Assert(holder.LockWithPID(), gc.IsNil)
+	c.Assert(holder.Unlock(), gc.IsNil)
+	broken, err = lock.BreakStaleLock()
+	c.Assert(err, gc.IsNil)
+	c.Assert(broken, gc.Equals, false)
+	c.Assert(lock.Held(), gc.Equals, false)
+
+	// Once it's dead, the lock is broken and the PID replaced.
+	kill := make(chan struct{})
+	defer close(kill)
+	<-LockFromAnotherProc(c, path, kill, "FSLOCK_TEST_HELPER_PID=1")
+	pid, err := lock.HolderPID()
+	c.Assert(err, gc.IsNil)
+	c.Assert(pid, gc.Not(gc.Equals), os.Getpid())
+	broken, err = lock.BreakStaleLock()
+	c.Assert(err, gc.IsNil)
+	c.Assert(broken, gc.Equals, true)
+	c.Assert(lock.Held(), gc.Equals, true)
+	pid, err = fslock.New(path).HolderPID()
+	c.Assert(err, gc.IsNil)
+	c.Assert(pid, gc.Equals, os.Getpid())
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestBudget(c *gc.C) {
+	dir := c.MkDir()
+	a := fslock.New(filepath.Join(dir, "a"))
+	b := fslock.New(filepath.Join(dir, "b"))
+	holder := fslock.New(filepath.Join(dir, "b"))
+	c.Assert(holder.Lock(), gc.IsNil)
+
+	budget := fslock.NewBudget(longWait)
+	c.Assert(budget.Lock(a), gc.IsNil)
+	c.Assert(budget.Remaining() > 0, gc.Equals, true)
+
+	// Waiting for b uses up the rest of the budget, and no more.
+	start := time.Now()
+	c.Assert(budget.Lock(b), gc.Equals, fslock.ErrTimeout)
+	c.Assert(time.Since(start) < longWait*2, gc.Equals, true)
+	c.Assert(budget.Remaining(), gc.Equals, time.Duration(0))
+	c.Assert(holder.Unlock(), gc.IsNil)
+	c.Assert(budget.Lock(b), gc.Equals, fslock.ErrTimeout)
+	c.Assert(b.Held(), gc.Equals, false)
+	c.Assert(a.Unlock(), gc.IsNil)
+
+	// Any Locker will do.
+	c.Assert(fslock.NewBudget(shortWait).Lock(fslock.NewMemLock()), gc.IsNil)
+}
+
+func (s *fslockSuite) TestLockWithDeadline(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "lockfile")
+	lock := fslock.New(path)
+	other := fslock.New(path)
+
+	// A deadline that has passed fails even though the lock is free.
+	c.Assert(lock.LockWithDeadline(time.Now().Add(-time.Second)), gc.Equals, fslock.ErrTimeout)
+	c.Assert(lock.Held(), gc.Equals, false)
+
+	c.Assert(lock.LockWithDeadline(time.Now().Add(longWait)), gc.IsNil)
+	start := time.Now()
+	c.Assert(other.LockWithDeadline(start.Add(shortWait)), gc.Equals, fslock.ErrTimeout)
+	c.Assert(time.Since(start) >= shortWait, gc.Equals, true)
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestLockWithTimeoutDurations(c *gc.C) {
+	for i, test := range []struct {
+		about   string
+		timeout time.Duration
+		// release is how long the lock is held by someone else before they
+		// release it, or 0 if it is free.
+		release time.Duration
+		err     error
+	}{{
+		about:   "negative timeout on a free lock",
+		timeout: -1,
+	}, {
+		about:   "zero timeout on a free lock",
+		timeout: 0,
+	}, {
+		about:   "positive timeout on a free lock",
+		timeout: shortWait,
+	}, {
+		about:   "negative timeout waits as long as it takes",
+		timeout: -1,
+		release: longWait,
+	}, {
+		about:   "zero timeout tries just once",
+		timeout: 0,
+		release: longWait,
+		err:     fslock.ErrTimeout,
+	}, {
+		about:   "positive timeout expires",
+		timeout: shortWait,
+		release: longWait,
+		err:     fslock.ErrTimeout,
+	}, {
+		about:   "positive timeout outlasts the holder",
+		timeout: longWait,
+		release: shortWait,
+	}, {
+		about:   "nanosecond timeout on a free lock",
+		timeout: time.Nanosecond,
+	}, {
+		about:   "nanosecond timeout expires",
+		timeout: time.Nanosecond,
+		release: longWait,
+		err:     fslock.ErrTimeout,
+	}, {
+		about:   "sub-millisecond timeout expires",
+		timeout: 999 * time.Microsecond,
+		release: longWait,
+		err:     fslock.ErrTimeout,
+	}, {
+		about:   "multi-hour timeout outlasts the holder",
+		timeout: 3 * time.Hour,
+		release: shortWait,
+	}, {
+		about:   "timeout of more than 49.7 days worth of milliseconds",
+		timeout: 1 << 62,
+		release: shortWait,
+	}, {
+		about:   "longest possible timeout",
+		timeout: math.MaxInt64,
+		release: shortWait,
+	}} {
+		c.Logf("test %d: %s", i, test.about)
+		path := filepath.Join(c.MkDir(), "lockfile")
+		lock := fslock.New(path)
+		released := make(chan struct{})
+		if test.release > 0 {
+			other := fslock.New(path)
+			c.Assert(other.Lock(), gc.IsNil)
+			go func() {
+				time.Sleep(test.release)
+				other.Unlock()
+				close(released)
+			}()
+		} else {
+			close(released)
+		}
+		c.Assert(lock.LockWithTimeout(test.timeout), gc.Equals, test.err)
+		<-released
+		if test.err == nil {
+			c.Assert(lock.Unlock(), gc.IsNil)
+		}
+	}
+}
+
+func (s *fslockSuite) TestAcquireAll(c *gc.C) {
+	dir := c.MkDir()
+	a := fslock.New(filepath.Join(dir, "a"))
+	b := fslock.New(filepath.Join(dir, "b"))
+	c.Assert(fslock.AcquireAll(b, a), gc.IsNil)
+	c.Assert(a.Held(), gc.Equals, true)
+	c.Assert(b.Held(), gc.Equals, true)
+	c.Assert(fslock.New(filepath.Join(dir, "a")).TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(fslock.ReleaseAll(b, a), gc.IsNil)
+	c.Assert(a.Held(), gc.Equals, false)
+	c.Assert(b.Held(), gc.Equals, false)
+
+	// A failure releases the locks already taken.
+	missing := fslock.New(filepath.Join(dir, "missing", "c"))
+	c.Assert(fslock.AcquireAll(missing, b, a), gc.NotNil)
+	c.Assert(a.Held(), gc.Equals, false)
+	c.Assert(b.Held(), gc.Equals, false)
+}
+
+func (s *fslockSuite) TestAcquireAny(c *gc.C) {
+	dir := c.MkDir()
+	paths := []string{filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")}
+
+	// Each claim gets a different file until they're all taken.
+	var claimed []*fslock.Lock
+	seen := make(map[string]bool)
+	for range paths {
+		l, err := fslock.AcquireAny(context.Background(), paths...)
+		c.Assert(err, gc.IsNil)
+		c.Assert(l.Held(), gc.Equals, true)
+		c.Assert(seen[l.Path()], gc.Equals, false)
+		seen[l.Path()] = true
+		claimed = append(claimed, l)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), shortWait)
+	defer cancel()
+	_, err := fslock.AcquireAny(ctx, paths...)
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+
+	// One is picked up as soon as it's released.
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(shortWait)
+		claimed[1].Unlock()
+		close(released)
+	}()
+	l, err := fslock.AcquireAny(context.Background(), paths...)
+	c.Assert(err, gc.IsNil)
+	c.Assert(l.Path(), gc.Equals, claimed[1].Path())
+	c.Assert(l.Unlock(), gc.IsNil)
+	<-released
+	c.Assert(fslock.ReleaseAll(claimed...), gc.IsNil)
+
+	_, err = fslock.AcquireAny(context.Background())
+	c.Assert(err, gc.Equals, fslock.ErrLocked)
+}
+
+func (s *fslockSuite) TestWithLock(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	failed := errors.New("failed")
+	err := fslock.WithLock(path, func() error {
+		c.Assert(fslock.New(path).TryLock(), gc.Equals, fslock.ErrLocked)
+		return failed
+	})
+	c.Assert(err, gc.Equals, failed)
+
+	// A panic still unlocks.
+	func() {
+		defer func() {
+			c.Assert(recover(), gc.Equals, "oops")
+		}()
+		fslock.WithLockContext(context.Background(), path, func() error {
+			panic("oops")
+		})
+	}()
+
+	holder := fslock.New(path)
+	c.Assert(holder.TryLock(), gc.IsNil)
+	ran := false
+	fn := func() error {
+		ran = true
+		return nil
+	}
+	c.Assert(fslock.TryWithLock(path, fn), gc.Equals, fslock.ErrLocked)
+	ctx, cancel := context.WithTimeout(context.Background(), shortWait)
+	defer cancel()
+	c.Assert(fslock.WithLockContext(ctx, path, fn), gc.Equals, context.DeadlineExceeded)
+	c.Assert(ran, gc.Equals, false)
+	c.Assert(holder.Unlock(), gc.IsNil)
+
+	c.Assert(fslock.TryWithLock(path, fn), gc.IsNil)
+	c.Assert(ran, gc.Equals, true)
+}
+
+func (s *fslockSuite) TestLockFile(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "lockfile")
+	lock := fslock.New(path)
+	other := fslock.New(path)
+
+	f, err := lock.LockFile()
+	c.Assert(err, gc.IsNil)
+	c.Assert(lock.Held(), gc.Equals, false)
+	c.Assert(other.TryLock(), gc.Equals, fslock.ErrLocked)
+
+	_, err = f.WriteAt([]byte("content"), 0)
+	c.Assert(err, gc.IsNil)
+	data := make([]byte, len("content"))
+	_, err = f.ReadAt(data, 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, "content")
+
+	// The lock now belongs to the file.
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(other.TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(f.Close(), gc.IsNil)
+	c.Assert(other.TryLock(), gc.IsNil)
+	c.Assert(other.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestExists(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "lockfile")
+	lock := fslock.New(path)
+
+	exists, err := lock.Exists()
+	c.Assert(err, gc.IsNil)
+	c.Assert(exists, gc.Equals, false)
+	// Checking doesn't create the file.
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	exists, err = lock.Exists()
+	c.Assert(err, gc.IsNil)
+	c.Assert(exists, gc.Equals, true)
+}
+
+func (s *fslockSuite) TestDirectoryNotRegularFile(c *gc.C) {
+	lock := fslock.New(c.MkDir())
+	err := lock.Lock()
+	c.Assert(errors.Is(err, fslock.ErrNotRegularFile), gc.Equals, true, gc.Commentf("%v", err))
+	err = lock.TryLock()
+	c.Assert(errors.Is(err, fslock.ErrNotRegularFile), gc.Equals, true, gc.Commentf("%v", err))
+	c.Assert(lock.Held(), gc.Equals, false)
+}
+
+func (s *fslockSuite) TestNewDir(c *gc.C) {
+	switch runtime.GOOS {
+	case "aix", "illumos", "solaris":
+		c.Skip("directories can't be locked exclusively with fcntl")
+	}
+	dir := c.MkDir()
+	lock := fslock.NewDir(dir)
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(fslock.NewDir(dir).TryLock(), gc.Equals, fslock.ErrLocked)
+	locked, err := fslock.NewDir(dir).IsLocked()
+	c.Assert(err, gc.IsNil)
+	c.Assert(locked, gc.Equals, true)
+	c.Assert(lock.Unlock(), gc.IsNil)
+
+	other := fslock.NewDir(dir)
+	c.Assert(other.TryLock(), gc.IsNil)
+	c.Assert(other.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestLockDirectory(c *gc.C) {
+	switch runtime.GOOS {
+	case "aix", "illumos", "solaris":
+		c.Skip("directories can't be locked exclusively with fcntl")
+	}
+	dir := c.MkDir()
+	lock, err := fslock.LockDirectory(dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(lock.Held(), gc.Equals, true)
+	c.Assert(fslock.NewDir(dir).TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(lock.Unlock(), gc.IsNil)
+
+	_, err = fslock.LockDirectory(filepath.Join(dir, "missing"))
+	c.Assert(errors.Is(err, os.ErrNotExist), gc.Equals, true)
+}
+
+func (s *fslockSuite) TestWithMkdirAll(c *gc.C) {
+	dir := c.MkDir()
+	path := filepath.Join(dir, "sub", "dir", "lockfile")
+	c.Assert(errors.Is(fslock.New(path).Lock(), os.ErrNotExist), gc.Equals, true)
+
+	lock := fslock.New(path, fslock.WithMkdirAll(0700))
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	info, err := os.Stat(filepath.Join(dir, "sub", "dir"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(info.IsDir(), gc.Equals, true)
+}
+
+func (s *fslockSuite) TestHeldFor(c *gc.C) {
+	lock := fslock.New(filepath.Join(c.MkDir(), "lockfile"))
+	c.Assert(lock.HeldFor(), gc.Equals, time.Duration(0))
+	c.Assert(lock.Lock(), gc.IsNil)
+	time.Sleep(shortWait)
+	c.Assert(lock.HeldFor() >= shortWait, gc.Equals, true)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(lock.HeldFor(), gc.Equals, time.Duration(0))
+}
+
+func (s *fslockSuite) TestUpgrade(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+
+	err := lock.RLock()
+	c.Assert(err, gc.IsNil)
+	err = lock.Upgrade()
+	c.Assert(err, gc.IsNil)
+	c.Assert(lock.Held(), gc.Equals, true)
+
+	// The lock is now exclusive.
+	err = fslock.New(path).TryRLock()
+	c.Assert(err, gc.Equals, fslock.ErrLocked)
+
+	err = lock.Unlock()
+	c.Assert(err, gc.IsNil)
+	err = fslock.New(path).TryLock()
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *fslockSuite) TestUpgradeWaitsForReaders(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	reader := fslock.New(path)
+
+	err := lock.RLock()
+	c.Assert(err, gc.IsNil)
+	defer lock.Unlock()
+	err = reader.RLock()
+	c.Assert(err, gc.IsNil)
+
+	upgraded := make(chan error, 1)
+	go func() {
+		upgraded <- lock.Upgrade()
+	}()
+	select {
+	case err := <-upgraded:
+		c.Fatalf("upgraded with another reader holding the lock: %v", err)
+	case <-time.After(shortWait):
+	}
+
+	err = reader.Unlock()
+	c.Assert(err, gc.IsNil)
+	select {
+	case err := <-upgraded:
+		c.Assert(err, gc.IsNil)
+	case <-time.After(longWait):
+		c.Fatalf("upgrade didn't happen once the reader let go")
+	}
+}
+
+func (s *fslockSuite) TestTryUpgradeKeepsSharedLock(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	reader := fslock.New(path)
+
+	err := lock.RLock()
+	c.Assert(err, gc.IsNil)
+	err = reader.RLock()
+	c.Assert(err, gc.IsNil)
+
+	err = lock.TryUpgrade()
+	c.Assert(err, gc.Equals, fslock.ErrLocked)
+	c.Assert(lock.Held(), gc.Equals, true)
+
+	// The shared lock is still held, so a writer is kept out even once the
+	// other reader has gone.
+	err = reader.Unlock()
+	c.Assert(err, gc.IsNil)
+	err = fslock.New(path).TryLock()
+	c.Assert(err, gc.Equals, fslock.ErrLocked)
+
+	err = lock.TryUpgrade()
+	c.Assert(err, gc.IsNil)
+	err = lock.Unlock()
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *fslockSuite) TestDowngrade(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+
+	err := lock.Lock()
+	c.Assert(err, gc.IsNil)
+	err = lock.Downgrade()
+	c.Assert(err, gc.IsNil)
+	c.Assert(lock.Held(), gc.Equals, true)
+
+	// Readers are let in, but writers are still kept out.
+	reader := fslock.New(path)
+	err = reader.TryRLock()
+	c.Assert(err, gc.IsNil)
+	err = reader.Unlock()
+	c.Assert(err, gc.IsNil)
+	err = fslock.New(path).TryLock()
+	c.Assert(err, gc.Equals, fslock.ErrLocked)
+
+	err = lock.Unlock()
+	c.Assert(err, gc.IsNil)
+	err = fslock.New(path).TryLock()
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *fslockSuite) TestUpgradeUnheldLocks(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+
+	err := lock.TryUpgrade()
+	c.Assert(err, gc.IsNil)
+	c.Assert(lock.Held(), gc.Equals, true)
+	err = lock.Unlock()
+	c.Assert(err, gc.IsNil)
+
+	err = lock.Upgrade()
+	c.Assert(err, gc.IsNil)
+	c.Assert(lock.Held(), gc.Equals, true)
+	err = lock.Unlock()
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *fslockSuite) BenchmarkTryLockContended(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+	defer holder.Unlock()
+	lock := fslock.New(path)
+	c.ResetTimer()
+	for i := 0; i < c.N; i++ {
+		if err := lock.TryLock(); err != fslock.ErrLocked {
+			c.Fatalf("TryLock returned %v", err)
+		}
+	}
+}
+
+func (s *fslockSuite) TestFinalizerUnlocksLeakedLock(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	var mu sync.Mutex
+	var messages []string
+	logger := func(format string, args ...interface{}) {
+		mu.Lock()
+		defer mu.Unlock()
+		messages = append(messages, fmt.Sprintf(format, args...))
+	}
+	func() {
+		lock := fslock.New(path, fslock.WithLogger(logger), fslock.WithFinalizer())
+		c.Assert(lock.Lock(), gc.IsNil)
+	}()
+
+	other := fslock.New(path)
+	for start := time.Now(); other.TryLock() != nil; {
+		if time.Since(start) > 5*time.Second {
+			c.Fatalf("leaked lock wasn't unlocked")
+		}
+		runtime.GC()
+		time.Sleep(shortWait)
+	}
+	c.Assert(other.Unlock(), gc.IsNil)
+	mu.Lock()
+	defer mu.Unlock()
+	c.Assert(strings.Join(messages, "\n"), gc.Matches, "(?s).*garbage collected while held.*")
+}
+
+func (s *fslockSuite) TestDroppedLockStaysHeld(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	c.Assert(fslock.New(path).Lock(), gc.IsNil)
+
+	other := fslock.New(path)
+	for i := 0; i < 5; i++ {
+		runtime.GC()
+		time.Sleep(shortWait)
+		c.Assert(other.TryLock(), gc.Equals, fslock.ErrLocked)
+	}
+}
+
+func (s *fslockSuite) TestFeatures(c *gc.C) {
+	features := fslock.Features()
+	c.Assert(features&fslock.Locking, gc.Equals, fslock.Locking)
+	path := filepath.Join(c.MkDir(), "testing")
+
+	lock := fslock.New(path)
+	err := lock.TryRLock()
+	if features&fslock.SharedLocks != 0 {
+		c.Assert(err, gc.IsNil)
+	} else {
+		c.Assert(err, gc.Equals, fslock.ErrUnsupported)
+	}
+	c.Assert(lock.Unlock(), gc.IsNil)
+
+	err = lock.TryLockRange(0, 1, true)
+	if features&fslock.RangeLocks != 0 {
+		c.Assert(err, gc.IsNil)
+	} else {
+		c.Assert(err, gc.Equals, fslock.ErrUnsupported)
+	}
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestWithMandatory(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path, fslock.WithMandatory())
+	if fslock.Features()&fslock.MandatoryLocks != 0 {
+		c.Assert(lock.Lock(), gc.IsNil)
+		c.Assert(lock.Unlock(), gc.IsNil)
+		return
+	}
+	c.Assert(lock.Lock(), gc.Equals, fslock.ErrMandatoryUnsupported)
+	c.Assert(lock.TryLock(), gc.Equals, fslock.ErrMandatoryUnsupported)
+	c.Assert(lock.LockWithTimeout(shortWait), gc.Equals, fslock.ErrMandatoryUnsupported)
+	c.Assert(lock.CreateLock(), gc.Equals, fslock.ErrMandatoryUnsupported)
+	c.Assert(lock.Held(), gc.Equals, false)
+	_, err := os.Stat(path)
+	c.Assert(os.IsNotExist(err), gc.Equals, true)
+}
+
+func (s *fslockSuite) TestWithDefaultTimeout(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+	lock := fslock.New(path, fslock.WithDefaultTimeout(shortWait))
+
+	start := time.Now()
+	c.Assert(lock.Lock(), gc.Equals, fslock.ErrTimeout)
+	c.Assert(time.Since(start) >= shortWait, gc.Equals, true)
+
+	// An explicit timeout takes precedence, even one that waits forever.
+	released := make(chan struct{})
+	go func() {
+		time.Sleep(longWait)
+		holder.Unlock()
+		close(released)
+	}()
+	c.Assert(lock.LockWithTimeout(-1), gc.IsNil)
+	<-released
+	c.Assert(lock.Unlock(), gc.IsNil)
+
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestRLockShared(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	first := fslock.New(path)
+	second := fslock.New(path)
+
+	err := first.RLock()
+	c.Assert(err, gc.IsNil)
+	defer first.Unlock()
+
+	// Another shared holder is admitted immediately.
+	err = second.TryRLock()
+	c.Assert(err, gc.IsNil)
+	defer second.Unlock()
+
+	// But an exclusive one is not.
+	err = fslock.New(path).TryLock()
+	c.Assert(err, gc.Equals, fslock.ErrLocked)
+}
+
+func (s *fslockSuite) TestTryRLockExcluded(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	writer := fslock.New(path)
+
+	err := writer.Lock()
+	c.Assert(err, gc.IsNil)
+
+	reader := fslock.New(path)
+	err = reader.TryRLock()
+	c.Assert(err, gc.Equals, fslock.ErrLocked)
+
+	err = writer.Unlock()
+	c.Assert(err, gc.IsNil)
+
+	err = reader.TryRLock()
+	c.Assert(err, gc.IsNil)
+	err = reader.Unlock()
+	c.Assert(err, gc.IsNil)
+}
+
 func (s *fslockSuite) TestStress(c *gc.C) {
 	const lockAttempts = 200
 	const concurrentLocks = 10
@@ -262,8 +2001,9 @@ func (s *fslockSuite) TestStress(c *gc.C) {
 
 // LockFromAnotherProc will launch a process and block until that process has
 // created the lock file.  If we time out waiting for the other process to take
-// the lock, this function will fail the current test.
-func LockFromAnotherProc(c *gc.C, path string, kill chan struct{}) (done chan struct{}) {
+// the lock, this function will fail the current test.  Any env given is added
+// to the other process's environment.
+func LockFromAnotherProc(c *gc.C, path string, kill chan struct{}, env ...string) (done chan struct{}) {
 	cmd := exec.Command(os.Args[0], "-test.run", "TestLockFromOtherProcess")
 	cmd.Env = append(
 		// We must preserve os.Environ() on Windows,
@@ -273,6 +2013,7 @@ func LockFromAnotherProc(c *gc.C, path string, kill chan struct{}) (done chan st
 		"FSLOCK_TEST_HELPER_WANTED=1",
 		"FSLOCK_TEST_HELPER_PATH="+path,
 	)
+	cmd.Env = append(cmd.Env, env...)
 
 	if err := cmd.Start(); err != nil {
 		c.Fatalf("error starting other proc: %v", err)
@@ -312,8 +2053,25 @@ func TestLockFromOtherProcess(t *testing.T) {
 		return
 	}
 	filename := os.Getenv("FSLOCK_TEST_HELPER_PATH")
-	lock := fslock.New(filename)
-	err := lock.Lock()
+	var opts []fslock.Option
+	if os.Getenv("FSLOCK_TEST_HELPER_BACKEND") == "fcntl" {
+		opts = append(opts, fslock.WithBackend(fslock.Fcntl))
+	}
+	lock := fslock.New(filename, opts...)
+	if os.Getenv("FSLOCK_TEST_HELPER_TRY") != "" {
+		// Just report whether the lock could be had, through the exit
+		// status.
+		switch err := lock.TryLock(); err {
+		case nil:
+			os.Exit(0)
+		case fslock.ErrLocked:
+			os.Exit(3)
+		default:
+			fmt.Fprintf(os.Stderr, "error locking %q: %v", filename, err)
+			os.Exit(1)
+		}
+	}
+	err := helperLock(lock)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error locking %q: %v", filename, err)
 		os.Exit(1)
@@ -326,3 +2084,18 @@ func TestLockFromOtherProcess(t *testing.T) {
 	}
 	os.Exit(0)
 }
+
+// helperLock takes the lock for TestLockFromOtherProcess, locking just the
+// exclusive range given as "offset:length" in FSLOCK_TEST_HELPER_RANGE if
+// that is set, and recording its PID if FSLOCK_TEST_HELPER_PID is set.
+func helperLock(lock *fslock.Lock) error {
+	if r := os.Getenv("FSLOCK_TEST_HELPER_RANGE"); r != "" {
+		var offset, length int64
+		fmt.Sscanf(r, "%d:%d", &offset, &length)
+		return lock.LockRange(offset, length, true)
+	}
+	if os.Getenv("FSLOCK_TEST_HELPER_PID") != "" {
+		return lock.LockWithPID()
+	}
+	return lock.Lock()
+}
@@ -4,90 +4,676 @@
 package fslock
 
 import (
+	"context"
+	"fmt"
 	"golang.org/x/sys/windows"
-	"log"
-	"syscall"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
 	"time"
 )
 
-func init() {
-
-	log.SetFlags(log.Lmicroseconds | log.Ldate)
-}
+// features is what Features reports here.
+const features = Locking | SharedLocks | RangeLocks | ContextCancel | PIDRecords | DirLocks | MandatoryLocks
 
 // Lock implements cross-process locks using syscalls.
 // This implementation is based on LockFileEx syscall.
 type Lock struct {
 	filename string
 	handle   windows.Handle
+	opts     options
+
+	// name is filename converted once for the Windows API, or nameErr if
+	// that failed.
+	name    *uint16
+	nameErr error
+
+	// ol is kept for the next overlapped I/O on the lock file, so that
+	// polling doesn't create and close an event every attempt.
+	olMu sync.Mutex
+	ol   *windows.Overlapped
+
+	// given is the handle passed to NewFromHandle, or InvalidHandle.  It is
+	// never closed, only unlocked.
+	given windows.Handle
+
+	mu        sync.Mutex
+	held      bool
+	heldSince time.Time
+	// releasedAt is when the lock was last released, for LockFair.
+	releasedAt time.Time
+	depth      int
+	stats      LockStats
+	// rnd jitters the waits of LockWithRetry and LockFair, and is created
+	// on first use.
+	rnd *rand.Rand
+
+	// refMu is held while the lock is acquired for a first reference.
+	refMu sync.Mutex
+	refs  int
 }
 
-// New returns a new lock around the given file.
-func New(filename string) *Lock {
-	return &Lock{filename: filename}
+// New returns a new lock around the given file, configured by any options
+// given.
+func New(filename string, opts ...Option) *Lock {
+	l := &Lock{
+		filename: filename,
+		handle:   windows.InvalidHandle,
+		given:    windows.InvalidHandle,
+		opts:     newOptions(opts),
+	}
+	// Convert the name up front, rather than on every attempt to lock.
+	l.name, l.nameErr = windows.UTF16PtrFromString(filename)
+	return l
+}
+
+// NewFromHandle returns a new lock around the already open file handle,
+// configured by any options given, for processes that are handed handles by a
+// supervisor and can't open the lock file themselves.  The name is used in
+// errors and log messages, and by the methods that work with the file by
+// name, such as HolderPID and UnlockAndRemove.  Unless the handle was opened
+// with FILE_FLAG_OVERLAPPED, waiting for the lock can't be given up, so
+// timeouts and contexts aren't honoured once the wait has begun.
+//
+// Unlock releases the lock but leaves the handle open for the caller to close
+// once the lock is no longer needed, unless LockFile has handed it over,
+// after which the lock opens name like any other.  Range locks taken through
+// the handle have to be released with UnlockRange.
+func NewFromHandle(handle windows.Handle, name string, opts ...Option) *Lock {
+	l := New(name, opts...)
+	l.given = handle
+	return l
+}
+
+// NewDir returns a new lock around the given directory, which must exist,
+// configured by any options given, for keeping other processes from working in
+// the directory at the same time.  Windows can't lock directories, so a lock
+// file named .lock in the directory, created hidden, is used instead, which
+// every process using the lock must get from NewDir.
+func NewDir(path string, opts ...Option) *Lock {
+	l := New(filepath.Join(path, dirLockFile), opts...)
+	l.opts.dir = true
+	return l
 }
 
 // TryLock attempts to lock the lock.  This method will return ErrLocked
 // immediately if the lock cannot be acquired.
 func (l *Lock) TryLock() error {
-	err := l.LockWithTimeout(0)
-	if err == ErrTimeout {
-		// in our case, timing out immediately just means it was already locked.
+	err := l.lock(context.Background(), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return ErrLocked
+	}
+	return err
+}
+
+// TryLockContextOnce makes a single attempt to lock the lock, as TryLock
+// does, but gives up if the context is done while the lock file is being
+// opened, which can hang on an unresponsive network share, returning the
+// context's error, or the cause it was canceled with, if any.  Unlike
+// LockWithContext it never waits for the lock, returning ErrLocked if it is
+// held.  A context that is already done still gets the one attempt.
+func (l *Lock) TryLockContextOnce(ctx context.Context) error {
+	err := l.lock(ctx, windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if err == windows.ERROR_LOCK_VIOLATION {
 		return ErrLocked
 	}
 	return err
 }
 
-// Lock locks the lock.  This call will block until the lock is available.
+// Lock locks the lock.  This call will block until the lock is available, or
+// until the timeout set by WithDefaultTimeout expires or the context given to
+// NewWithContext is done.
 func (l *Lock) Lock() error {
-	return l.LockWithTimeout(-1)
+	if l.opts.defaultTimeout >= 0 {
+		return l.LockWithTimeout(l.opts.defaultTimeout)
+	}
+	return l.LockWithContext(l.context())
 }
 
-// Unlock unlocks the lock.
-func (l *Lock) Unlock() error {
-	return windows.Close(l.handle)
+// RLock locks the lock for shared use.  Any number of shared holders may hold
+// the lock at once, but an exclusive holder excludes them all.  This call will
+// block until the lock is available.
+//
+// A Lock instance holds either a shared or an exclusive lock at a time; to
+// switch between the two, call Upgrade or Downgrade.
+func (l *Lock) RLock() error {
+	return l.lock(context.Background(), 0)
 }
 
-// LockWithTimeout tries to lock the lock until the timeout expires.  If the
-// timeout expires, this method will return ErrTimeout.
-func (l *Lock) LockWithTimeout(timeout time.Duration) (oerr error) {
-	name, err := windows.UTF16PtrFromString(l.filename)
-	if err != nil {
-		return err
+// TryRLock attempts to lock the lock for shared use.  This method will return
+// ErrLocked immediately if the lock is held exclusively by someone else.
+func (l *Lock) TryRLock() error {
+	err := l.lock(context.Background(), windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return ErrLocked
 	}
+	return err
+}
 
-	// Open for asynchronous I/O so that we can timeout waiting for the lock.
-	// Also open shared so that other processes can open the file (but will
-	// still need to lock it).
+// Upgrade converts a shared lock held by this instance into an exclusive one,
+// blocking until no other shared holders remain.  If the lock isn't held,
+// Upgrade locks it like Lock does.
+//
+// LockFileEx can't convert a lock in place, so the conversion isn't atomic:
+// the shared lock is released before waiting for the exclusive one, another
+// process may take the lock exclusively in between, and whatever was read
+// under the shared lock must be read again afterwards.
+func (l *Lock) Upgrade() error {
+	if !l.Held() {
+		return l.Lock()
+	}
+	if err := unlockRegion(l.handle, wholeFile); err != nil {
+		return l.pathError("unlock", err)
+	}
+	l.logf("waiting")
+	if err := l.lockRegion(context.Background(), l.handle, windows.LOCKFILE_EXCLUSIVE_LOCK, wholeFile); err != nil {
+		l.logf("upgrade failed: %v", err)
+		l.released()
+		l.close()
+		return l.pathError("lock", err)
+	}
+	l.logf("upgraded")
+	return nil
+}
+
+// TryUpgrade attempts to convert a shared lock held by this instance into an
+// exclusive one, returning ErrLocked immediately if anyone else holds the
+// lock.  The shared lock is taken back when that happens, except in the rare
+// case that another process takes the lock exclusively in the moment it is
+// released for the conversion; the lock is then lost, and Held reports false.
+// If the lock isn't held, TryUpgrade locks it like TryLock does.
+func (l *Lock) TryUpgrade() error {
+	if !l.Held() {
+		return l.TryLock()
+	}
+	if err := unlockRegion(l.handle, wholeFile); err != nil {
+		return l.pathError("unlock", err)
+	}
+	flags := uint32(windows.LOCKFILE_EXCLUSIVE_LOCK | windows.LOCKFILE_FAIL_IMMEDIATELY)
+	err := l.lockRegion(context.Background(), l.handle, flags, wholeFile)
+	if err == nil {
+		l.logf("upgraded")
+		return nil
+	}
+	if err == windows.ERROR_LOCK_VIOLATION {
+		l.logf("already locked")
+		err = l.lockRegion(context.Background(), l.handle, windows.LOCKFILE_FAIL_IMMEDIATELY, wholeFile)
+		if err == nil {
+			return ErrLocked
+		}
+	}
+	l.logf("lost shared lock: %v", err)
+	l.released()
+	l.close()
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return ErrLocked
+	}
+	return l.pathError("lock", err)
+}
+
+// Downgrade converts an exclusive lock held by this instance into a shared
+// one, letting other readers in while this instance keeps reading.  If the
+// lock isn't held, Downgrade locks it like RLock does.
+//
+// Unlike with flock, the conversion isn't atomic: the exclusive lock is
+// released before the shared one is taken, so another process may take the
+// lock exclusively in between, in which case Downgrade waits for it.
+func (l *Lock) Downgrade() error {
+	if !l.Held() {
+		return l.RLock()
+	}
+	if err := unlockRegion(l.handle, wholeFile); err != nil {
+		return l.pathError("unlock", err)
+	}
+	if err := l.lockRegion(context.Background(), l.handle, 0, wholeFile); err != nil {
+		l.logf("downgrade failed: %v", err)
+		l.released()
+		l.close()
+		return l.pathError("lock", err)
+	}
+	l.logf("downgraded")
+	return nil
+}
+
+// IsLocked reports whether the lock is currently held, exclusively or shared,
+// by anyone, including this instance.  It does not acquire the lock or
+// create the lock file, and leaves any lock held by this instance untouched.
+func (l *Lock) IsLocked() (bool, error) {
+	if l.given != windows.InvalidHandle {
+		// The lock file might not be ours to open, so probe through the
+		// handle we were given, unless that holds the lock already.
+		if l.Held() {
+			return true, nil
+		}
+		return l.probe(l.given)
+	}
+	if l.nameErr != nil {
+		return false, l.pathError("open", l.nameErr)
+	}
 	handle, err := windows.CreateFile(
-		name,
+		l.name,
 		windows.GENERIC_READ,
-		windows.FILE_SHARE_READ,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE,
 		nil,
-		windows.OPEN_ALWAYS,
-		windows.FILE_FLAG_OVERLAPPED|windows.FILE_ATTRIBUTE_NORMAL,
+		windows.OPEN_EXISTING,
+		windows.FILE_ATTRIBUTE_NORMAL,
 		0)
+	if err == windows.ERROR_FILE_NOT_FOUND {
+		return false, nil
+	}
+	if err != nil {
+		return false, l.pathError("open", err)
+	}
+	defer windows.Close(handle)
+	return l.probe(handle)
+}
+
+// probe reports whether the lock is held by anyone else, by trying to lock it
+// through handle.
+func (l *Lock) probe(handle windows.Handle) (bool, error) {
+	flags := uint32(windows.LOCKFILE_EXCLUSIVE_LOCK | windows.LOCKFILE_FAIL_IMMEDIATELY)
+	err := l.lockRegion(context.Background(), handle, flags, wholeFile)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return true, nil
+	}
 	if err != nil {
+		return false, l.pathError("lock", err)
+	}
+	return false, l.pathError("unlock", unlockRegion(handle, wholeFile))
+}
+
+// CreateLock creates the lock file and locks it, returning ErrExists if the
+// file already exists, for pidfile-style locks where the file existing at all
+// means the lock is taken.  It doesn't wait: if someone opens the new file
+// and locks it first, CreateLock returns ErrLocked.  Like LockWithPID, it
+// records this process's PID in the file.
+//
+// The file is left behind by a holder that crashes, and until it is removed
+// CreateLock keeps returning ErrExists.  BreakStaleLock can tell whether the
+// PID recorded belongs to a process that has gone and take the lock over, and
+// UnlockAndRemove removes the file when the lock is no longer needed.
+func (l *Lock) CreateLock() error {
+	if l.Held() {
+		return ErrAlreadyHeld
+	}
+	if l.handle != windows.InvalidHandle || l.given != windows.InvalidHandle {
+		return ErrExists
+	}
+	start := l.startWait()
+	handle, err := l.openFile(windows.CREATE_NEW)
+	if err == ErrExists {
+		l.logf("already exists")
 		return err
 	}
+	if err != nil {
+		l.logf("open failed: %v", err)
+		return l.pathError("open", err)
+	}
+	l.logf("created")
+	flags := uint32(windows.LOCKFILE_EXCLUSIVE_LOCK | windows.LOCKFILE_FAIL_IMMEDIATELY)
+	if err := l.lockRegion(context.Background(), handle, flags, wholeFile); err != nil {
+		windows.Close(handle)
+		if err == windows.ERROR_LOCK_VIOLATION {
+			l.logf("already locked")
+			return ErrLocked
+		}
+		l.logf("lock failed: %v", err)
+		return l.pathError("lock", err)
+	}
 	l.handle = handle
-	defer func() {
-		if oerr != nil {
+	l.acquired(start)
+	return l.recordPID()
+}
+
+// Unlock unlocks the lock, whether it was acquired exclusively or shared.
+// Unlocking an instance that doesn't hold the lock does nothing and returns
+// nil, or ErrNotHeld with WithStrictUnlock.
+func (l *Lock) Unlock() error {
+	if l.leave() {
+		return nil
+	}
+	notHeld := l.unlockNotHeld()
+	l.released()
+	l.olMu.Lock()
+	if l.ol != nil {
+		closeOverlapped(l.ol)
+		l.ol = nil
+	}
+	l.olMu.Unlock()
+	// InvalidHandle represents that the lock isn't held.
+	if l.handle == windows.InvalidHandle {
+		return notHeld
+	}
+	if err := l.close(); err != nil {
+		return err
+	}
+	return notHeld
+}
+
+// close closes the lock file, releasing any lock held through it.  The
+// handle given to NewFromHandle is only unlocked.
+func (l *Lock) close() error {
+	if l.given != windows.InvalidHandle && l.handle == l.given {
+		l.handle = windows.InvalidHandle
+		err := unlockRegion(l.given, wholeFile)
+		if err == windows.ERROR_NOT_LOCKED {
+			// Only ranges were locked through it.
+			return nil
+		}
+		return l.pathError("unlock", err)
+	}
+	err := windows.Close(l.handle)
+	l.handle = windows.InvalidHandle
+	return l.pathError("close", err)
+}
+
+// LockFile locks the lock like Lock does, then hands the lock file over to the
+// caller, open for reading and writing, so that its content can be used under
+// the lock.  Closing the file releases the lock, and until the lock is next
+// acquired Unlock does nothing, however many times a reentrant lock was held.
+//
+// The lock file is open for overlapped I/O, which os.File only supports from
+// Go 1.25.
+func (l *Lock) LockFile() (*os.File, error) {
+	if err := l.Lock(); err != nil {
+		return nil, err
+	}
+	f := os.NewFile(uintptr(l.handle), l.filename)
+	l.handle = windows.InvalidHandle
+	l.given = windows.InvalidHandle
+	l.disown()
+	return f, nil
+}
+
+// Handle returns the handle of the lock file, and whether it is open, for
+// callers that wait on it from their own event loop.  The file is open while
+// the lock is held, and after a range lock has been taken until Unlock.  The
+// handle still belongs to the lock: closing it, or locking or unlocking it
+// other than through the lock, releases or confuses the lock, and it is only
+// good until Unlock closes it.
+func (l *Lock) Handle() (windows.Handle, bool) {
+	if l.handle == windows.InvalidHandle {
+		return windows.InvalidHandle, false
+	}
+	return l.handle, true
+}
+
+// UnlockAndRemove unlocks the lock, then removes the lock file, for lock files
+// that shouldn't outlive their use.  The file is only removed if nobody else
+// has it open, so anyone already waiting for the lock keeps its file, unless
+// it was opened with a share mode including FILE_SHARE_DELETE.  A
+// reentrant lock held more than once is only unlocked, as by Unlock.
+func (l *Lock) UnlockAndRemove() error {
+	if !l.Held() || l.nested() {
+		return l.Unlock()
+	}
+	if err := l.Unlock(); err != nil {
+		return err
+	}
+	if l.nameErr != nil {
+		return l.pathError("remove", l.nameErr)
+	}
+	// Unless the share mode includes FILE_SHARE_DELETE, this fails while
+	// anyone else has the lock file open.
+	err := windows.DeleteFile(l.name)
+	if err == windows.ERROR_SHARING_VIOLATION || err == windows.ERROR_FILE_NOT_FOUND {
+		return nil
+	}
+	return l.pathError("remove", err)
+}
+
+// LockWithContext tries to lock the lock until the context is done.  If the
+// context is done first, this method will return the context's error, or the
+// cause it was canceled with, if any.
+func (l *Lock) LockWithContext(ctx context.Context) error {
+	return l.lock(ctx, windows.LOCKFILE_EXCLUSIVE_LOCK)
+}
+
+// lock opens the lock file and calls LockFileEx with the given flags, waiting
+// for the lock to be granted until ctx is done.
+func (l *Lock) lock(ctx context.Context, flags uint32) error {
+	if done, err := l.reenter(); done {
+		return err
+	}
+	start := l.startWait()
+	err := l.lockFile(ctx, flags)
+	switch {
+	case err == nil:
+		l.acquired(start)
+	case err == windows.ERROR_LOCK_VIOLATION:
+		l.logf("already locked")
+	case err == contextError(ctx):
+		l.logf("gave up waiting: %v", err)
+	}
+	return err
+}
+
+// lockFile does the work of lock, leaving the held state alone.
+func (l *Lock) lockFile(ctx context.Context, flags uint32) error {
+	// Lock through the handle a range lock left open, if any, rather than
+	// leaking it and the ranges locked through it.
+	handle := l.handle
+	if handle == windows.InvalidHandle {
+		var err error
+		handle, err = l.openFileContext(ctx)
+		if err != nil && err == contextError(ctx) {
+			return err
+		}
+		if err != nil {
+			l.logf("open failed: %v", err)
+			return l.pathError("open", err)
+		}
+		l.logf("opened")
+	}
+	// Try without waiting first, to tell whether the lock is contended.
+	err := l.lockRegion(ctx, handle, flags|windows.LOCKFILE_FAIL_IMMEDIATELY, wholeFile)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		l.contended()
+		if flags&windows.LOCKFILE_FAIL_IMMEDIATELY == 0 {
+			l.logf("waiting")
+			err = l.lockRegion(ctx, handle, flags, wholeFile)
+		}
+	}
+	if err != nil {
+		if handle != l.given && handle != l.handle {
 			windows.Close(handle)
 		}
+		if err == windows.ERROR_LOCK_VIOLATION || err == contextError(ctx) {
+			return err
+		}
+		l.logf("lock failed: %v", err)
+		return l.pathError("lock", err)
+	}
+	l.handle = handle
+	if err := l.checkStale(); err != nil {
+		l.close()
+		return err
+	}
+	return nil
+}
+
+// checkStale returns ErrStale if WithStaleCheck was given and the file locked
+// through l.handle is no longer the lock file.
+func (l *Lock) checkStale() error {
+	if !l.opts.staleCheck {
+		return nil
+	}
+	same, err := l.sameFile()
+	if err != nil {
+		return err
+	}
+	if !same {
+		l.logf("lock file replaced while locking")
+		return ErrStale
+	}
+	return nil
+}
+
+// sameFile reports whether the file open as l.handle is still the lock file,
+// rather than having been removed or replaced.
+func (l *Lock) sameFile() (bool, error) {
+	var open, named windows.ByHandleFileInformation
+	if err := windows.GetFileInformationByHandle(l.handle, &open); err != nil {
+		return false, l.pathError("stat", err)
+	}
+	if l.nameErr != nil {
+		return false, l.pathError("stat", l.nameErr)
+	}
+	// Opening for no access at all is enough to identify the file, and
+	// doesn't conflict with anyone's share mode.
+	handle, err := windows.CreateFile(
+		l.name,
+		0,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil,
+		windows.OPEN_EXISTING,
+		windows.FILE_FLAG_BACKUP_SEMANTICS,
+		0)
+	if err == windows.ERROR_FILE_NOT_FOUND {
+		return false, nil
+	}
+	if err != nil {
+		return false, l.pathError("stat", err)
+	}
+	defer windows.Close(handle)
+	if err := windows.GetFileInformationByHandle(handle, &named); err != nil {
+		return false, l.pathError("stat", err)
+	}
+	return open.VolumeSerialNumber == named.VolumeSerialNumber &&
+		open.FileIndexHigh == named.FileIndexHigh &&
+		open.FileIndexLow == named.FileIndexLow, nil
+}
+
+// touch sets the lock file's access and modification times to t.  It opens
+// the file afresh rather than using l.handle, which Unlock may be closing
+// meanwhile, for attribute access only, which doesn't conflict with anyone's
+// share mode.
+func (l *Lock) touch(t time.Time) error {
+	if l.nameErr != nil {
+		return l.nameErr
+	}
+	handle, err := windows.CreateFile(
+		l.name,
+		windows.FILE_WRITE_ATTRIBUTES,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE|windows.FILE_SHARE_DELETE,
+		nil,
+		windows.OPEN_EXISTING,
+		windows.FILE_FLAG_BACKUP_SEMANTICS,
+		0)
+	if err != nil {
+		return err
+	}
+	defer windows.Close(handle)
+	ft := windows.NsecToFiletime(t.UnixNano())
+	return windows.SetFileTime(handle, nil, &ft, &ft)
+}
+
+// openFileContext opens the lock file like openFile does, but gives up when
+// ctx is done, as opening a file on an unresponsive network share can hang.
+// An open given up on is closed if it ever completes.
+func (l *Lock) openFileContext(ctx context.Context) (windows.Handle, error) {
+	// A context that is already done still gets one attempt at the lock,
+	// as with a lock timeout too short to wait for anything.
+	if l.given != windows.InvalidHandle || ctx.Done() == nil || ctx.Err() != nil {
+		return l.openFile(windows.OPEN_ALWAYS)
+	}
+	type result struct {
+		handle windows.Handle
+		err    error
+	}
+	opened := make(chan result, 1)
+	go func() {
+		handle, err := l.openFile(windows.OPEN_ALWAYS)
+		opened <- result{handle, err}
 	}()
+	select {
+	case r := <-opened:
+		return r.handle, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-opened; r.err == nil {
+				windows.Close(r.handle)
+			}
+		}()
+		return windows.InvalidHandle, contextError(ctx)
+	}
+}
 
-	millis := uint32(windows.INFINITE)
-	if timeout >= 0 {
-		millis = uint32(timeout.Nanoseconds() / 1000000)
+// openFile opens the lock file with the given CreateFile creation
+// disposition, or OPEN_EXISTING in place of OPEN_ALWAYS with WithNoCreate.
+func (l *Lock) openFile(disposition uint32) (windows.Handle, error) {
+	if l.given != windows.InvalidHandle {
+		return l.given, nil
+	}
+	if l.nameErr != nil {
+		return windows.InvalidHandle, l.nameErr
+	}
+	if err := l.mkdirAll(); err != nil {
+		return windows.InvalidHandle, err
+	}
+	if l.opts.noCreate && disposition == windows.OPEN_ALWAYS {
+		disposition = windows.OPEN_EXISTING
 	}
 
-	ol, err := newOverlapped()
+	attrs := uint32(windows.FILE_ATTRIBUTE_NORMAL)
+	if l.opts.dir {
+		// The lock file stands in for the directory, so keep it out of the
+		// way of whatever is in the directory.
+		attrs = windows.FILE_ATTRIBUTE_HIDDEN
+	}
+
+	// Open for asynchronous I/O so that we can timeout waiting for the lock.
+	// Also open shared, by default for reading and writing, so that other
+	// processes can open the file (but will still need to lock it).  Write
+	// access is needed to record the holder's PID.
+	handle, err := windows.CreateFile(
+		l.name,
+		windows.GENERIC_READ|windows.GENERIC_WRITE,
+		l.opts.shareMode,
+		nil,
+		disposition,
+		windows.FILE_FLAG_OVERLAPPED|attrs,
+		0)
+	if err == windows.ERROR_FILE_EXISTS {
+		err = ErrExists
+	}
+	if err == windows.ERROR_FILE_NOT_FOUND && disposition == windows.OPEN_EXISTING {
+		err = ErrNotExist
+	}
+	if err == windows.ERROR_ACCESS_DENIED {
+		// That's also what opening a directory gives.
+		if fi, serr := os.Stat(l.filename); serr == nil && fi.IsDir() {
+			err = ErrNotRegularFile
+		}
+	}
+	return handle, err
+}
+
+// region is a range of bytes in a file to lock.
+type region struct {
+	offset, length uint64
+}
+
+// wholeFile is the region locked by the whole file lock methods: just the
+// first byte, which is enough as everyone locking the file locks it.
+var wholeFile = region{offset: 0, length: 1}
+
+// lockRegion calls LockFileEx with the given flags to lock a region of the
+// file open as handle, waiting for the lock to be granted until ctx is done.
+func (l *Lock) lockRegion(ctx context.Context, handle windows.Handle, flags uint32, r region) error {
+	ol, err := l.newOverlapped()
 	if err != nil {
 		return err
 	}
-	defer windows.CloseHandle(ol.HEvent)
-	err = windows.LockFileEx(handle, windows.LOCKFILE_EXCLUSIVE_LOCK, 0, 1, 0, ol)
+	defer l.doneOverlapped(ol)
+	ol.Offset, ol.OffsetHigh = split(r.offset)
+	lengthLow, lengthHigh := split(r.length)
+	err = windows.LockFileEx(handle, flags, 0, lengthLow, lengthHigh, ol)
 	if err == nil {
 		return nil
 	}
@@ -97,27 +683,168 @@ func (l *Lock) LockWithTimeout(timeout time.Duration) (oerr error) {
 	if err != windows.ERROR_IO_PENDING {
 		return err
 	}
-	s, err := windows.WaitForSingleObject(ol.HEvent, millis)
+	if ctx.Done() == nil {
+		// This context can never be canceled, so just wait.
+		return waitResult(handle, ol)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		result <- waitResult(handle, ol)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		// Cancelling the pending LockFileEx signals the event, so the waiting
+		// goroutine is done with ol once it has sent its result.  If the lock
+		// was granted in the meantime, release it again.
+		windows.CancelIoEx(handle, ol)
+		<-result
+		var done uint32
+		if windows.GetOverlappedResult(handle, ol, &done, false) == nil {
+			unlockRegion(handle, r)
+		}
+		return contextError(ctx)
+	}
+}
+
+// unlockRegion unlocks a region of the file open as handle.
+func unlockRegion(handle windows.Handle, r region) error {
+	ol := new(windows.Overlapped)
+	ol.Offset, ol.OffsetHigh = split(r.offset)
+	lengthLow, lengthHigh := split(r.length)
+	return windows.UnlockFileEx(handle, 0, lengthLow, lengthHigh, ol)
+}
+
+// split splits v into the low and high dwords that Windows APIs take.
+func split(v uint64) (low, high uint32) {
+	return uint32(v), uint32(v >> 32)
+}
 
+// waitResult waits for the operation pending on ol to complete and returns
+// its result, which for a LockFileEx that was to fail immediately can still be
+// ERROR_LOCK_VIOLATION.
+func waitResult(handle windows.Handle, ol *windows.Overlapped) error {
+	if err := wait(ol.HEvent); err != nil {
+		return err
+	}
+	var done uint32
+	return windows.GetOverlappedResult(handle, ol, &done, false)
+}
+
+// waitForSingleObject is the function wait uses to wait for an event, which
+// tests replace to see how each result is handled.
+var waitForSingleObject = windows.WaitForSingleObject
+
+// wait blocks until the given event is signaled.
+func wait(event windows.Handle) error {
+	s, err := waitForSingleObject(event, windows.INFINITE)
 	switch s {
-	case syscall.WAIT_OBJECT_0:
+	case windows.WAIT_OBJECT_0:
 		// success!
 		return nil
-	case syscall.WAIT_TIMEOUT:
+	case windows.WAIT_FAILED:
+		// err is what GetLastError said about the failure.
+		if err == nil {
+			err = windows.GetLastError()
+		}
+		if err == nil {
+			err = windows.ERROR_INVALID_FUNCTION
+		}
+		return fmt.Errorf("wait: %w", err)
+	case windows.WAIT_ABANDONED:
+		// Only a mutex can be abandoned, by a thread that exits holding it,
+		// which an event never should be.
+		return fmt.Errorf("wait: event handle abandoned")
+	case uint32(windows.WAIT_TIMEOUT):
+		// Not while waiting forever, but a timeout is a timeout.
 		return ErrTimeout
 	default:
+		return fmt.Errorf("wait: unexpected result %#x", s)
+	}
+}
+
+// writeRecord replaces the content of the lock file with record.  The record
+// is written after the first byte, which is the byte LockFileEx locks and so
+// can't be read by anyone else while the lock is held; that byte is set to a
+// space so the content still parses the same as on other platforms.
+func (l *Lock) writeRecord(record []byte) error {
+	ol, err := l.newOverlapped()
+	if err != nil {
 		return err
 	}
+	defer l.doneOverlapped(ol)
+
+	data := append([]byte{' '}, record...)
+	var done uint32
+	err = windows.WriteFile(l.handle, data, &done, ol)
+	if err == windows.ERROR_IO_PENDING {
+		err = windows.GetOverlappedResult(l.handle, ol, &done, true)
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := windows.Seek(l.handle, int64(len(data)), 0); err != nil {
+		return err
+	}
+	return windows.SetEndOfFile(l.handle)
+}
+
+// readRecord returns the record written by writeRecord, skipping the locked
+// first byte.
+func (l *Lock) readRecord() ([]byte, error) {
+	f, err := os.Open(l.filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ioutil.ReadAll(io.NewSectionReader(f, 1, math.MaxInt64-1))
 }
 
 // newOverlapped creates a structure used to track asynchronous
-// I/O requests that have been issued.
-func newOverlapped() (*windows.Overlapped, error) {
+// I/O requests that have been issued, reusing the one the lock kept from its
+// last request.  Pass it to doneOverlapped once the request is complete.
+func (l *Lock) newOverlapped() (*windows.Overlapped, error) {
+	l.olMu.Lock()
+	ol := l.ol
+	l.ol = nil
+	l.olMu.Unlock()
+	if ol != nil {
+		event := ol.HEvent
+		if err := windows.ResetEvent(event); err == nil {
+			*ol = windows.Overlapped{HEvent: event}
+			return ol, nil
+		}
+		closeOverlapped(ol)
+	}
 	manualReset := uint32(1)
 	initialState := uint32(0)
 	event, err := windows.CreateEvent(nil, manualReset, initialState, nil)
 	if err != nil {
 		return nil, err
 	}
-	return &windows.Overlapped{HEvent: event}, nil
+	ol = &windows.Overlapped{HEvent: event}
+	// Like os.File, close the event of a lock dropped without Unlock.
+	runtime.SetFinalizer(ol, closeOverlapped)
+	return ol, nil
+}
+
+// doneOverlapped keeps a structure from newOverlapped for the lock's next
+// request, or closes its event if the lock already has one.
+func (l *Lock) doneOverlapped(ol *windows.Overlapped) {
+	l.olMu.Lock()
+	if l.ol == nil {
+		l.ol, ol = ol, nil
+	}
+	l.olMu.Unlock()
+	if ol != nil {
+		closeOverlapped(ol)
+	}
+}
+
+// closeOverlapped closes the event of a structure from newOverlapped.
+func closeOverlapped(ol *windows.Overlapped) {
+	runtime.SetFinalizer(ol, nil)
+	windows.CloseHandle(ol.HEvent)
 }
@@ -0,0 +1,284 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/windows"
+	gc "gopkg.in/check.v1"
+
+	"github.com/xianic/fslock"
+)
+
+func (s *fslockSuite) TestWithShareMode(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path, fslock.WithShareMode(windows.FILE_SHARE_READ))
+	c.Assert(lock.Lock(), gc.IsNil)
+	defer lock.Unlock()
+
+	// Without write sharing, nobody else can open the file to wait for the
+	// lock, though they can still read it.
+	err := fslock.New(path).TryLock()
+	c.Assert(err, gc.NotNil)
+	c.Assert(err, gc.Not(gc.Equals), fslock.ErrLocked)
+	f, err := os.Open(path)
+	c.Assert(err, gc.IsNil)
+	f.Close()
+}
+
+func (s *fslockSuite) TestNewFromHandle(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	name, err := windows.UTF16PtrFromString(path)
+	c.Assert(err, gc.IsNil)
+	handle, err := windows.CreateFile(
+		name,
+		windows.GENERIC_READ|windows.GENERIC_WRITE,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE,
+		nil,
+		windows.OPEN_ALWAYS,
+		windows.FILE_FLAG_OVERLAPPED|windows.FILE_ATTRIBUTE_NORMAL,
+		0)
+	c.Assert(err, gc.IsNil)
+	defer windows.Close(handle)
+
+	lock := fslock.NewFromHandle(handle, path)
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(fslock.New(path).TryLock(), gc.Equals, fslock.ErrLocked)
+
+	// Unlocking leaves the handle open, and it can be locked again.
+	c.Assert(lock.Unlock(), gc.IsNil)
+	var info windows.ByHandleFileInformation
+	c.Assert(windows.GetFileInformationByHandle(handle, &info), gc.IsNil)
+	c.Assert(lock.TryLock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestNewFromHandleUnlockError(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	name, err := windows.UTF16PtrFromString(path)
+	c.Assert(err, gc.IsNil)
+	handle, err := windows.CreateFile(
+		name,
+		windows.GENERIC_READ|windows.GENERIC_WRITE,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE,
+		nil,
+		windows.OPEN_ALWAYS,
+		windows.FILE_FLAG_OVERLAPPED|windows.FILE_ATTRIBUTE_NORMAL,
+		0)
+	c.Assert(err, gc.IsNil)
+
+	// The given handle is only unlocked, so that is what a failure is
+	// reported as.
+	lock := fslock.NewFromHandle(handle, path)
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(windows.Close(handle), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.ErrorMatches, `fslock: unlock ".*": .*`)
+}
+
+func (s *fslockSuite) TestLockWithFlags(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	other := fslock.New(path)
+	c.Assert(lock.LockWithFlags(windows.LOCKFILE_EXCLUSIVE_LOCK, 10, 10), gc.IsNil)
+	c.Assert(other.LockWithFlags(windows.LOCKFILE_FAIL_IMMEDIATELY, 15, 1), gc.Equals, fslock.ErrLocked)
+
+	// Shared locks don't exclude each other, and other ranges are free.
+	c.Assert(other.LockWithFlags(windows.LOCKFILE_FAIL_IMMEDIATELY, 20, 10), gc.IsNil)
+	c.Assert(lock.UnlockRange(10, 10), gc.IsNil)
+	c.Assert(lock.LockWithFlags(windows.LOCKFILE_FAIL_IMMEDIATELY, 25, 1), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(other.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestHandle(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	_, ok := lock.Handle()
+	c.Assert(ok, gc.Equals, false)
+
+	c.Assert(lock.Lock(), gc.IsNil)
+	handle, ok := lock.Handle()
+	c.Assert(ok, gc.Equals, true)
+	var info windows.ByHandleFileInformation
+	c.Assert(windows.GetFileInformationByHandle(handle, &info), gc.IsNil)
+
+	c.Assert(lock.Unlock(), gc.IsNil)
+	_, ok = lock.Handle()
+	c.Assert(ok, gc.Equals, false)
+}
+
+func (s *fslockSuite) TestWaitResults(c *gc.C) {
+	event, err := windows.CreateEvent(nil, 1, 1, nil)
+	c.Assert(err, gc.IsNil)
+	defer windows.Close(event)
+	c.Assert(fslock.Wait(event), gc.IsNil)
+	err = fslock.Wait(0)
+	c.Assert(errors.Is(err, windows.ERROR_INVALID_HANDLE), gc.Equals, true)
+
+	for _, t := range []struct {
+		result uint32
+		err    error
+		check  func(c *gc.C, err error)
+	}{{
+		result: windows.WAIT_OBJECT_0,
+		check: func(c *gc.C, err error) {
+			c.Assert(err, gc.IsNil)
+		},
+	}, {
+		result: windows.WAIT_FAILED,
+		err:    windows.ERROR_ACCESS_DENIED,
+		check: func(c *gc.C, err error) {
+			c.Assert(errors.Is(err, windows.ERROR_ACCESS_DENIED), gc.Equals, true)
+		},
+	}, {
+		result: windows.WAIT_ABANDONED,
+		check: func(c *gc.C, err error) {
+			c.Assert(err, gc.ErrorMatches, "wait: event handle abandoned")
+		},
+	}, {
+		result: uint32(windows.WAIT_TIMEOUT),
+		check: func(c *gc.C, err error) {
+			c.Assert(err, gc.Equals, fslock.ErrTimeout)
+		},
+	}, {
+		result: 0x42,
+		check: func(c *gc.C, err error) {
+			c.Assert(err, gc.ErrorMatches, "wait: unexpected result 0x42")
+		},
+	}} {
+		c.Logf("result %#x", t.result)
+		restore := fslock.SetWaitForSingleObject(func(windows.Handle, uint32) (uint32, error) {
+			return t.result, t.err
+		})
+		err := fslock.Wait(event)
+		restore()
+		t.check(c, err)
+	}
+}
+
+func (s *fslockSuite) TestNewDirHidesLockFile(c *gc.C) {
+	dir := c.MkDir()
+	lock := fslock.NewDir(dir)
+	c.Assert(lock.Lock(), gc.IsNil)
+	defer lock.Unlock()
+	name, err := windows.UTF16PtrFromString(filepath.Join(dir, ".lock"))
+	c.Assert(err, gc.IsNil)
+	attrs, err := windows.GetFileAttributes(name)
+	c.Assert(err, gc.IsNil)
+	c.Assert(attrs&windows.FILE_ATTRIBUTE_HIDDEN, gc.Not(gc.Equals), uint32(0))
+}
+
+func (s *fslockSuite) TestLockExcludesOtherInstances(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	other := fslock.New(path)
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(other.TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(other.TryRLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(other.TryLock(), gc.IsNil)
+	c.Assert(other.Unlock(), gc.IsNil)
+}
+
+func (s *fslockSuite) TestUnlockAndRemoveNeedsHold(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	share := fslock.WithShareMode(windows.FILE_SHARE_READ | windows.FILE_SHARE_WRITE | windows.FILE_SHARE_DELETE)
+	holder := fslock.New(path, share)
+	c.Assert(holder.Lock(), gc.IsNil)
+	defer holder.Unlock()
+
+	// A range lock leaves the file open, but nothing to remove from under
+	// the holder.
+	lock := fslock.New(path, share)
+	c.Assert(lock.TryLockRange(10, 1, true), gc.IsNil)
+	c.Assert(lock.UnlockAndRemove(), gc.IsNil)
+	_, err := os.Stat(path)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *fslockSuite) TestLockReusesRangeHandle(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	lock := fslock.New(path)
+	c.Assert(lock.TryLockRange(10, 1, true), gc.IsNil)
+	before, ok := lock.Handle()
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(lock.CreateLock(), gc.Equals, fslock.ErrExists)
+
+	// The whole file is locked through the same handle, so Unlock releases
+	// the range too rather than leaking it.
+	c.Assert(lock.TryLock(), gc.IsNil)
+	after, ok := lock.Handle()
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(after, gc.Equals, before)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	other := fslock.New(path)
+	c.Assert(other.TryLockRange(10, 1, true), gc.IsNil)
+	c.Assert(other.Unlock(), gc.IsNil)
+}
+
+// BenchmarkOverlappedReused measures the overlapped structure each request
+// takes, as the lock reuses it from one request to the next.
+func BenchmarkOverlappedReused(b *testing.B) {
+	lock := fslock.New(filepath.Join(b.TempDir(), "testing"))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := fslock.CycleOverlapped(lock); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.StopTimer()
+	lock.Unlock()
+}
+
+// BenchmarkOverlappedCreated measures creating and closing an event for each
+// request instead, for comparison with BenchmarkOverlappedReused.
+func BenchmarkOverlappedCreated(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		event, err := windows.CreateEvent(nil, 1, 0, nil)
+		if err != nil {
+			b.Fatal(err)
+		}
+		ol := &windows.Overlapped{HEvent: event}
+		windows.CloseHandle(ol.HEvent)
+	}
+}
+
+func (s *fslockSuite) TestLockAfterRLockOnSameHandle(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	name, err := windows.UTF16PtrFromString(path)
+	c.Assert(err, gc.IsNil)
+	handle, err := windows.CreateFile(
+		name,
+		windows.GENERIC_READ|windows.GENERIC_WRITE,
+		windows.FILE_SHARE_READ|windows.FILE_SHARE_WRITE,
+		nil,
+		windows.OPEN_ALWAYS,
+		windows.FILE_FLAG_OVERLAPPED|windows.FILE_ATTRIBUTE_NORMAL,
+		0)
+	c.Assert(err, gc.IsNil)
+	defer windows.Close(handle)
+
+	// A shared lock on the handle doesn't stop it being locked exclusively
+	// afterwards, whether through an unlock or an upgrade.
+	lock := fslock.NewFromHandle(handle, path)
+	c.Assert(lock.RLock(), gc.IsNil)
+	reader := fslock.New(path)
+	c.Assert(reader.TryRLock(), gc.IsNil)
+	c.Assert(reader.Unlock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(lock.TryLock(), gc.IsNil)
+	c.Assert(fslock.New(path).TryRLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(lock.Unlock(), gc.IsNil)
+
+	c.Assert(lock.RLock(), gc.IsNil)
+	c.Assert(lock.TryUpgrade(), gc.IsNil)
+	c.Assert(fslock.New(path).TryRLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
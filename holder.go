@@ -0,0 +1,104 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Holder describes the holder of a lock, as recorded by LockWithHolder.
+type Holder struct {
+	// Host is the name of the host the holder runs on.
+	Host string `json:"host"`
+
+	// PID is the holder's process ID on that host.
+	PID int `json:"pid"`
+
+	// Since is when the holder acquired the lock.
+	Since time.Time `json:"since"`
+}
+
+// LockWithHolder locks the lock like Lock does, then records this host's
+// name, this process's PID and the time as JSON in a file next to the lock
+// file, named after it with ".holder" appended, so that Holder can report who
+// holds the lock.  Unlike the bare PID recorded by LockWithPID, this still
+// makes sense for lock files shared between hosts over NFS.
+//
+// The record is written to a temporary file that is then renamed into place,
+// so Holder never sees it half written.  It is left behind when the lock is
+// unlocked.
+func (l *Lock) LockWithHolder() error {
+	if err := l.Lock(); err != nil {
+		return err
+	}
+	if err := l.recordHolder(); err != nil {
+		l.Unlock()
+		return l.pathError("record holder", err)
+	}
+	return nil
+}
+
+// Holder returns the holder of the lock, as recorded by LockWithHolder, or
+// the zero Holder if the lock isn't held.  It ignores a record left behind by
+// an earlier holder, but it can still return one if the current holder didn't
+// use LockWithHolder, and the holder may have let go by the time it returns.
+func (l *Lock) Holder() (Holder, error) {
+	locked, err := l.IsLocked()
+	if err != nil || !locked {
+		return Holder{}, err
+	}
+	data, err := ioutil.ReadFile(l.holderFile())
+	if os.IsNotExist(err) {
+		return Holder{}, nil
+	}
+	if err != nil {
+		return Holder{}, err
+	}
+	var h Holder
+	if err := json.Unmarshal(data, &h); err != nil {
+		return Holder{}, l.pathError("parse holder", err)
+	}
+	return h, nil
+}
+
+// holderFile returns the name of the file LockWithHolder records the holder
+// in.
+func (l *Lock) holderFile() string {
+	return l.filename + ".holder"
+}
+
+// recordHolder replaces the holder file with a record of this process.
+func (l *Lock) recordHolder() error {
+	host, err := os.Hostname()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(Holder{Host: host, PID: os.Getpid(), Since: time.Now()})
+	if err != nil {
+		return err
+	}
+	name := l.holderFile()
+	f, err := ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Chmod(l.opts.mode)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
@@ -0,0 +1,163 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+import (
+	"context"
+	"os"
+	"sync"
+	"time"
+)
+
+// Lease is a lock taken by LockLease, which is kept alive by touching the lock
+// file every heartbeat until it is closed.
+type Lease struct {
+	lock *Lock
+	// file is the lock file as it was when the lease was taken.
+	file os.FileInfo
+	stop chan struct{}
+	done chan struct{}
+	// closeOnce stops the heartbeat and unlocks, however many Close calls
+	// race to.
+	closeOnce sync.Once
+	// err is why the heartbeat stopped early, if it did, and is only
+	// looked at once done is closed.
+	err error
+}
+
+// LockLease locks the lock like LockWithContext does, touches the lock file,
+// and then touches it every heartbeat until the returned lease is closed, so
+// that other processes can tell the lock is still in use.  A holder that stops
+// touching the file for longer than ttl, because it hung or because the system
+// lost track of its lock, can have its lease broken by BreakExpiredLease.  The
+// lock is released by closing the lease, not by unlocking the lock.
+//
+// A heartbeat that isn't positive and shorter than ttl is taken as ttl/3, to
+// leave time for a late heartbeat or two before the lease expires.
+//
+// The lock file is stamped with the time on the host touching it, and
+// BreakExpiredLease compares that with the time on its own host, so on lock
+// files shared between hosts their clocks must agree to well within the
+// margin between heartbeat and ttl.
+func (l *Lock) LockLease(ctx context.Context, ttl, heartbeat time.Duration) (*Lease, error) {
+	if heartbeat <= 0 || heartbeat >= ttl {
+		heartbeat = ttl / 3
+	}
+	if heartbeat <= 0 {
+		heartbeat = time.Millisecond
+	}
+	if err := l.LockWithContext(ctx); err != nil {
+		return nil, err
+	}
+	if err := l.Touch(); err != nil {
+		l.Unlock()
+		return nil, err
+	}
+	fi, err := os.Stat(l.filename)
+	if err != nil {
+		l.Unlock()
+		return nil, l.pathError("stat", err)
+	}
+	lease := &Lease{
+		lock: l,
+		file: fi,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go lease.heartbeat(heartbeat)
+	return lease, nil
+}
+
+// heartbeat renews the lease every interval until it is closed or can't be
+// renewed.
+func (ls *Lease) heartbeat(interval time.Duration) {
+	defer close(ls.done)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ls.stop:
+			return
+		case <-ticker.C:
+		}
+		if err := ls.renew(); err != nil {
+			ls.lock.logf("lease lost: %v", err)
+			ls.err = err
+			return
+		}
+	}
+}
+
+// renew touches the lock file, unless it has been replaced because the lease
+// was broken, in which case it returns ErrStale.
+func (ls *Lease) renew() error {
+	fi, err := os.Stat(ls.lock.filename)
+	if os.IsNotExist(err) || err == nil && !os.SameFile(fi, ls.file) {
+		return ErrStale
+	}
+	if err != nil {
+		return ls.lock.pathError("stat", err)
+	}
+	return ls.lock.Touch()
+}
+
+// Close stops the heartbeat and unlocks the lock.  If the heartbeat stopped
+// early, because the lease was broken by BreakExpiredLease or the lock file
+// couldn't be touched, Close returns why; a broken lease gives ErrStale.
+// Closing a lease again, even at the same time, does nothing more.
+func (ls *Lease) Close() error {
+	var err error
+	ls.closeOnce.Do(func() {
+		close(ls.stop)
+		<-ls.done
+		err = ls.lock.Unlock()
+	})
+	if ls.err != nil {
+		return ls.err
+	}
+	return err
+}
+
+// BreakExpiredLease removes the lock file if it is locked but hasn't been
+// touched for longer than ttl, as when it is held by a LockLease holder that
+// has stopped renewing its lease, and reports whether it did.  Whoever locks
+// the lock next, with LockLease or otherwise, locks a new file, and the old
+// holder's lease stops when it next tries to renew it.  A lock that isn't
+// held, or doesn't exist, is left alone.
+//
+// The file is only removed if it is still the one that was found to have
+// expired, but another process breaking the same lease at the same moment
+// could still remove the new file made by a holder that got in between, so
+// breakers should be rare and their ttl generous.  On Windows a file that is
+// open can't be removed unless the holder shares it for deletion, so breaking
+// a lease there needs WithShareMode to include FILE_SHARE_DELETE.  See
+// LockLease on how the hosts' clocks need to agree.
+func (l *Lock) BreakExpiredLease(ttl time.Duration) (broken bool, err error) {
+	fi, err := os.Stat(l.filename)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, l.pathError("stat", err)
+	}
+	if time.Since(fi.ModTime()) <= ttl {
+		return false, nil
+	}
+	locked, err := l.IsLocked()
+	if err != nil || !locked {
+		return false, err
+	}
+	if cur, err := os.Stat(l.filename); err != nil || !os.SameFile(cur, fi) {
+		// Someone else got there first.
+		return false, nil
+	}
+	if err := os.Remove(l.filename); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, l.pathError("remove", err)
+	}
+	l.logf("broke expired lease")
+	return true, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+import (
+	"sync"
+	"time"
+)
+
+// NewMemLock returns a Locker that only locks within the current process
+// and never touches the filesystem, for use in tests of code that accepts a
+// Locker.  It is safe for concurrent use, and stands for the lock file rather
+// than for one Lock instance: every caller contends for it as if with an
+// instance of its own, so locking it while it is held waits for it, or fails
+// with ErrLocked or ErrTimeout as an instance would when someone else holds
+// the lock, even where the caller that holds it locks it again.  Unlike a
+// Lock instance, it never returns ErrAlreadyHeld.
+func NewMemLock() Locker {
+	return &memLock{released: make(chan struct{})}
+}
+
+type memLock struct {
+	mu   sync.Mutex
+	held bool
+	// released is closed, and replaced, whenever the lock is unlocked.
+	released chan struct{}
+}
+
+// Lock implements Locker.
+func (m *memLock) Lock() error {
+	return m.lock(nil)
+}
+
+// TryLock implements Locker.
+func (m *memLock) TryLock() error {
+	if _, ok := m.tryLock(); !ok {
+		return ErrLocked
+	}
+	return nil
+}
+
+// LockWithTimeout implements Locker.
+func (m *memLock) LockWithTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return m.lock(nil)
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	return m.lock(timer.C)
+}
+
+// Unlock implements Locker.
+func (m *memLock) Unlock() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.held {
+		m.held = false
+		close(m.released)
+		m.released = make(chan struct{})
+	}
+	return nil
+}
+
+// lock waits for the lock until it is acquired or timeout fires, returning
+// ErrTimeout in the latter case.
+func (m *memLock) lock(timeout <-chan time.Time) error {
+	for {
+		released, ok := m.tryLock()
+		if ok {
+			return nil
+		}
+		select {
+		case <-released:
+		case <-timeout:
+			return ErrTimeout
+		}
+	}
+}
+
+// tryLock acquires the lock if it is free.  Otherwise it returns a channel
+// that is closed when the lock is next unlocked.
+func (m *memLock) tryLock() (<-chan struct{}, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.held {
+		return m.released, false
+	}
+	m.held = true
+	return nil, true
+}
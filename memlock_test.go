@@ -0,0 +1,107 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/xianic/fslock"
+)
+
+type memLockSuite struct{}
+
+var _ = gc.Suite(&memLockSuite{})
+
+func (s *memLockSuite) TestTryLock(c *gc.C) {
+	lock := fslock.NewMemLock()
+	c.Assert(lock.TryLock(), gc.IsNil)
+	c.Assert(lock.TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(lock.TryLock(), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	// Unlocking when not locked is harmless.
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *memLockSuite) TestLockWithTimeout(c *gc.C) {
+	lock := fslock.NewMemLock()
+	c.Assert(lock.LockWithTimeout(shortWait), gc.IsNil)
+	c.Assert(lock.LockWithTimeout(shortWait), gc.Equals, fslock.ErrTimeout)
+	c.Assert(lock.LockWithTimeout(0), gc.Equals, fslock.ErrTimeout)
+
+	go func() {
+		time.Sleep(shortWait)
+		lock.Unlock()
+	}()
+	c.Assert(lock.LockWithTimeout(longWait), gc.IsNil)
+
+	// A negative timeout waits for as long as it takes.
+	go func() {
+		time.Sleep(shortWait)
+		lock.Unlock()
+	}()
+	c.Assert(lock.LockWithTimeout(-1), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
+
+func (s *memLockSuite) TestLockBlocks(c *gc.C) {
+	lock := fslock.NewMemLock()
+	c.Assert(lock.Lock(), gc.IsNil)
+
+	acquired := make(chan struct{})
+	go func() {
+		lock.Lock()
+		close(acquired)
+	}()
+
+	select {
+	case <-acquired:
+		c.Fatalf("Unexpected lock acquisition")
+	case <-time.After(shortWait):
+	}
+	c.Assert(lock.Unlock(), gc.IsNil)
+	select {
+	case <-acquired:
+	case <-time.After(longWait):
+		c.Fatalf("Timed out waiting for lock acquisition.")
+	}
+}
+
+func (s *memLockSuite) TestStress(c *gc.C) {
+	const lockAttempts = 200
+	const concurrentLocks = 10
+
+	lock := fslock.NewMemLock()
+	var lockState int32
+	var wg sync.WaitGroup
+	for i := 0; i < concurrentLocks; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < lockAttempts; i++ {
+				c.Check(lock.Lock(), gc.IsNil)
+				c.Check(atomic.AddInt32(&lockState, 1), gc.Equals, int32(1))
+				atomic.AddInt32(&lockState, -1)
+				c.Check(lock.Unlock(), gc.IsNil)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func (s *memLockSuite) TestRelockWaits(c *gc.C) {
+	// The lock stands for the file, not one instance, so relocking it while
+	// held has to wait, rather than returning ErrAlreadyHeld.
+	lock := fslock.NewMemLock()
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(lock.TryLock(), gc.Equals, fslock.ErrLocked)
+	c.Assert(lock.LockWithTimeout(shortWait), gc.Equals, fslock.ErrTimeout)
+	c.Assert(lock.Unlock(), gc.IsNil)
+	c.Assert(lock.LockWithTimeout(shortWait), gc.IsNil)
+	c.Assert(lock.Unlock(), gc.IsNil)
+}
@@ -0,0 +1,101 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+import (
+	"context"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// AcquireAll locks all the given locks, blocking until each is available.
+// They are locked in order of filename rather than the order given, so that
+// processes locking overlapping sets of files can't deadlock one another, as
+// long as they all name each file the same way.  If locking any of them
+// fails, those already locked are unlocked again and the error is returned.
+//
+// Each lock file should appear only once, as separate instances for the same
+// file exclude each other.
+func AcquireAll(locks ...*Lock) error {
+	sorted := byFilename(locks)
+	for i, l := range sorted {
+		if err := l.Lock(); err != nil {
+			releaseAll(sorted[:i])
+			return err
+		}
+	}
+	return nil
+}
+
+// AcquireAny locks whichever of the given lock files it finds free first and
+// returns its lock, for claiming one of a pool of resources, such as worker
+// slots, each represented by a lock file.  It tries each file in turn without
+// waiting, starting from a random one so that processes claiming from the
+// same pool don't all contend for the same file, and goes round again,
+// backing off a little more each time, until one is free or the context is
+// done, in which case it returns the context's error, or the cause it was
+// canceled with, if any.  Any other error locking a file is returned straight
+// away.  With no files to try, it returns ErrLocked.
+func AcquireAny(ctx context.Context, paths ...string) (*Lock, error) {
+	if len(paths) == 0 {
+		return nil, ErrLocked
+	}
+	locks := make([]*Lock, len(paths))
+	for i, path := range paths {
+		locks[i] = New(path)
+	}
+	next := rand.New(rand.NewSource(time.Now().UnixNano())).Intn(len(locks))
+	delay := time.Millisecond
+	for {
+		for range locks {
+			l := locks[next]
+			next = (next + 1) % len(locks)
+			err := l.TryLock()
+			if err == nil {
+				return l, nil
+			}
+			if err != ErrLocked {
+				return nil, err
+			}
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, contextError(ctx)
+		case <-timer.C:
+		}
+		if delay < 500*time.Millisecond {
+			delay *= 2
+		}
+	}
+}
+
+// ReleaseAll unlocks all the given locks, in the reverse of the order that
+// AcquireAll locks them.  All of them are unlocked even if some fail, and
+// the first error is returned.
+func ReleaseAll(locks ...*Lock) error {
+	return releaseAll(byFilename(locks))
+}
+
+// byFilename returns a copy of locks sorted by filename.
+func byFilename(locks []*Lock) []*Lock {
+	sorted := append([]*Lock(nil), locks...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].filename < sorted[j].filename
+	})
+	return sorted
+}
+
+// releaseAll unlocks locks in reverse order, returning the first error.
+func releaseAll(locks []*Lock) error {
+	var first error
+	for i := len(locks) - 1; i >= 0; i-- {
+		if err := locks[i].Unlock(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
@@ -0,0 +1,293 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+import (
+	"context"
+	"os"
+	"time"
+)
+
+// Option configures a Lock created by New.
+type Option func(*options)
+
+// options holds the configuration of a Lock.
+type options struct {
+	mode      os.FileMode
+	reentrant bool
+	backend   Backend
+	logger    func(string, ...interface{})
+	hooks     *Hooks
+	shareMode uint32
+	// dir is set by NewDir.
+	dir       bool
+	mkdirAll  bool
+	mkdirPerm os.FileMode
+	noCreate  bool
+	// strictUnlock is set by WithStrictUnlock.
+	strictUnlock bool
+	// mandatory is set by WithMandatory.
+	mandatory bool
+	// openAttempts is how many times to try opening the lock file, 1 unless
+	// set by WithOpenRetry.
+	openAttempts int
+	// finalizer is set by WithFinalizer.
+	finalizer bool
+	keepOpen  bool
+	// defaultTimeout is negative unless set by WithDefaultTimeout.
+	defaultTimeout time.Duration
+	staleCheck     bool
+	// ctx is set by NewWithContext.
+	ctx context.Context
+	// events is set by WithSlog.
+	events func(debug bool, msg string, args ...interface{})
+	// chown is set by WithChown, with the owner and group to give.
+	chown    bool
+	uid, gid int
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		mode: 0600,
+		// FILE_SHARE_READ|FILE_SHARE_WRITE
+		shareMode:      0x1 | 0x2,
+		defaultTimeout: -1,
+		openAttempts:   1,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithFileMode sets the permissions the lock file is created with, 0600 by
+// default.  The mode is only used when the lock file doesn't already exist,
+// and is subject to the process umask, unless WithChown is given too.  It is
+// ignored on Windows.
+func WithFileMode(mode os.FileMode) Option {
+	return func(o *options) {
+		o.mode = mode
+	}
+}
+
+// WithReentrant makes the lock reentrant: locking it while this instance
+// already holds it succeeds immediately, and the lock is only released by
+// the Unlock that balances the first acquisition.  Reentrancy is a property
+// of the instance, not of a goroutine, and doesn't extend to other instances
+// or processes, which are excluded as usual.  Without it, locking an instance
+// that already holds the lock returns ErrAlreadyHeld.
+func WithReentrant() Option {
+	return func(o *options) {
+		o.reentrant = true
+	}
+}
+
+// Backend is a mechanism for locking files on Unix.
+type Backend int
+
+const (
+	// Flock locks with flock, the default.
+	Flock Backend = iota
+
+	// OFD locks with Linux's open file description locks, fcntl record locks
+	// that like flock locks belong to the open file rather than the process,
+	// so closing some other descriptor for the file doesn't drop them.  Where
+	// they aren't available, including on kernels older than 3.15, Flock is
+	// used instead.
+	OFD
+
+	// Fcntl locks with classic POSIX fcntl record locks, which unlike flock
+	// locks are supported by NFS on all kernels, through its lock manager.
+	// However they belong to the process rather than the open file, so
+	// instances in the same process don't exclude each other, and closing any
+	// descriptor the process has for the file releases them; use only one
+	// instance per lock file in a process.
+	Fcntl
+)
+
+// WithBackend sets the mechanism used to lock the file on Unix, Flock by
+// default.  Every process using a lock file must use the same backend, as
+// locks taken by different backends don't necessarily exclude each other.
+// It is ignored on Windows.
+func WithBackend(backend Backend) Option {
+	return func(o *options) {
+		o.backend = backend
+	}
+}
+
+// WithLogger sets a function, such as log.Printf, that is passed a diagnostic
+// message, in the form of a format and arguments, each time the lock file is
+// opened, waited on, acquired or released, or a lock attempt fails.  By
+// default nothing is logged.
+func WithLogger(logf func(format string, args ...interface{})) Option {
+	return func(o *options) {
+		o.logger = logf
+	}
+}
+
+// Hooks are functions called as a lock is acquired and released, for example
+// to collect metrics.  Any of them may be nil.  They aren't called for
+// reentrant acquisitions, which don't touch the lock file.
+type Hooks struct {
+	// OnWaitStart is called as an attempt to acquire the lock begins,
+	// whether or not it goes on to succeed.
+	OnWaitStart func()
+
+	// OnAcquired is called once the lock has been acquired, with how long
+	// the attempt took.
+	OnAcquired func(waited time.Duration)
+
+	// OnReleased is called once the lock has been released, with how long
+	// it was held.
+	OnReleased func(held time.Duration)
+}
+
+// WithHooks sets functions to be called as the lock is acquired and
+// released.  By default there are none.
+func WithHooks(hooks Hooks) Option {
+	return func(o *options) {
+		o.hooks = &hooks
+	}
+}
+
+// WithShareMode sets the share mode the lock file is opened with on Windows,
+// a combination of the FILE_SHARE_* flags, FILE_SHARE_READ|FILE_SHARE_WRITE
+// by default.  Every process using a lock file must share the access the
+// others open it with, read and write, or they fail to open it at all rather
+// than waiting for the lock.  It is ignored on other platforms.
+func WithShareMode(mode uint32) Option {
+	return func(o *options) {
+		o.shareMode = mode
+	}
+}
+
+// WithMkdirAll makes the lock create any missing parent directories of the
+// lock file, with the given permissions, before opening it.  By default a
+// missing directory is an error.
+func WithMkdirAll(perm os.FileMode) Option {
+	return func(o *options) {
+		o.mkdirAll = true
+		o.mkdirPerm = perm
+	}
+}
+
+// WithNoCreate makes the lock open only a lock file that already exists, so
+// that a mistyped path is reported rather than creating a stray lock file
+// there.  Locking a lock whose file is missing returns an error for which
+// errors.Is reports ErrNotExist.  CreateLock, which exists to create the
+// file, ignores it.
+func WithNoCreate() Option {
+	return func(o *options) {
+		o.noCreate = true
+	}
+}
+
+// WithOpenRetry makes opening the lock file try up to attempts times when it
+// fails in a way that may soon pass, such as being interrupted by a signal or
+// running out of file descriptors for a moment, backing off between attempts
+// from a millisecond up to half a second or so.  Other errors, such as a
+// missing directory or a lack of permission, are returned at once, as they are
+// by default for every error.  An attempts below one is taken as one.  It is
+// ignored off Unix.
+func WithOpenRetry(attempts int) Option {
+	return func(o *options) {
+		if attempts < 1 {
+			attempts = 1
+		}
+		o.openAttempts = attempts
+	}
+}
+
+// WithStrictUnlock makes Unlock return ErrNotHeld when this instance doesn't
+// hold the lock, because it was never locked, has already been unlocked or
+// handed its file over with LockFile, rather than the nil it returns by
+// default, for catching unbalanced unlocks.  Anything left open, such as the
+// file a range lock was taken through, is closed either way.
+func WithStrictUnlock() Option {
+	return func(o *options) {
+		o.strictUnlock = true
+	}
+}
+
+// WithMandatory asks for a mandatory lock, one the system enforces by keeping
+// other processes from reading and writing the lock file while it is held,
+// rather than one that only excludes other processes that lock it too.
+//
+// The locks this package takes on Unix are advisory: flock and POSIX record
+// locks don't stop anyone using the file, and Linux dropped its mandatory
+// locking altogether.  There every method that locks the file, or a range of
+// it, returns ErrMandatoryUnsupported rather than letting the caller believe
+// the file is protected.  Locks are always mandatory on Windows, where
+// LockFileEx keeps others from reading and writing the locked bytes, though a
+// whole file lock only covers the first byte, and on Plan 9, where nobody
+// else can even open an exclusive-use file while the lock is held, so there
+// WithMandatory changes nothing.  Features reports which with MandatoryLocks.
+func WithMandatory() Option {
+	return func(o *options) {
+		o.mandatory = true
+	}
+}
+
+// WithFinalizer has the lock set a finalizer while it is held, so that a
+// lock garbage collected while held is unlocked, logging that it happened,
+// rather than staying held until the program exits.  Without it a lock can
+// be taken and the *Lock dropped, as in fslock.New(path).Lock() at the top
+// of main, and it is held for the life of the process.
+func WithFinalizer() Option {
+	return func(o *options) {
+		o.finalizer = true
+	}
+}
+
+// WithKeepOpen keeps the lock file open after TryLock or TryRLock fails to
+// get the lock, so that a loop polling for it doesn't open and close the file
+// on every attempt.  The file is closed by Unlock, or when a LockWithContext
+// or LockWithTimeout gives up.  A failed attempt doesn't lock anything, so the
+// open file excludes nobody.  It is ignored off Unix.
+func WithKeepOpen() Option {
+	return func(o *options) {
+		o.keepOpen = true
+	}
+}
+
+// WithDefaultTimeout makes Lock give up after the timeout, returning
+// ErrTimeout, rather than waiting for as long as it takes, so that the timeout
+// doesn't have to be passed to every call.  As with LockWithTimeout, a zero
+// timeout tries just once, and a negative one waits for as long as it takes.
+// It applies to the methods built on Lock, such as LockWithPID and
+// AcquireAll, but not to LockWithTimeout, LockWithDeadline and
+// LockWithContext, which use the timeout, deadline or context given them.
+func WithDefaultTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.defaultTimeout = timeout
+	}
+}
+
+// WithStaleCheck makes the lock check, once it has locked the lock file, that
+// the file is still the one at the lock file's path, and otherwise unlock it
+// and return ErrStale.  Replacing the lock file, as by renaming another file
+// over it, while someone is waiting for it leaves them to lock the old file
+// once it is released, excluding nobody who opens the path afterwards; this
+// makes the lock belong to the path rather than to whichever file it opened.
+// It is ignored on Plan 9, where opening the file is what locks it.
+func WithStaleCheck() Option {
+	return func(o *options) {
+		o.staleCheck = true
+	}
+}
+
+// WithChown makes the lock give the lock file the owner uid and group gid when
+// it creates the file, for lock directories shared by daemons running as
+// different users; as with chown, -1 leaves either unchanged.  The file is
+// also given exactly the mode from WithFileMode, regardless of the process
+// umask, which would otherwise tend to take away the group's access.  Files
+// that already exist are left alone.  Giving a file to another owner usually
+// needs privilege, and if it fails, locking fails.  It is ignored on Windows
+// and Plan 9.
+func WithChown(uid, gid int) Option {
+	return func(o *options) {
+		o.chown = true
+		o.uid, o.gid = uid, gid
+	}
+}
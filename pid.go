@@ -0,0 +1,127 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+)
+
+// ErrIncompletePID indicates HolderPID found a PID that is still being
+// written to the lock file.
+var ErrIncompletePID error = pidError("lock file holds a partially written PID")
+
+type pidError string
+
+func (p pidError) Error() string {
+	return string(p)
+}
+
+func (pidError) Temporary() bool {
+	return true
+}
+
+// LockWithPID locks the lock like Lock does, then records the PID of the
+// current process in the lock file so that others can tell who holds it.
+// The PID is written while the lock is held exclusively, so shared holders
+// never see it half written.
+//
+// The PID is left in the file when the lock is unlocked, so a PID on its own
+// doesn't mean the lock is held; use IsLocked to find out.
+func (l *Lock) LockWithPID() error {
+	if err := l.Lock(); err != nil {
+		return err
+	}
+	return l.recordPID()
+}
+
+// recordPID writes the PID of the current process to the lock file, which
+// must be held exclusively, unlocking it if that fails.
+func (l *Lock) recordPID() error {
+	record := strconv.Itoa(os.Getpid()) + "\n"
+	if err := l.writeRecord([]byte(record)); err != nil {
+		l.Unlock()
+		return l.pathError("write", err)
+	}
+	return nil
+}
+
+// HolderPID returns the PID recorded in the lock file by LockWithPID, or 0 if
+// no PID has been recorded.  It neither takes nor waits for the lock, so if
+// it catches the holder part way through writing its PID it returns
+// ErrIncompletePID; trying again shortly afterwards should succeed.
+func (l *Lock) HolderPID() (int, error) {
+	record, err := l.readRecord()
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err == ErrUnsupported {
+		return 0, err
+	}
+	if err != nil {
+		return 0, l.pathError("read", err)
+	}
+	if len(record) == 0 {
+		return 0, nil
+	}
+	// LockWithPID always writes the trailing newline last.
+	if record[len(record)-1] != '\n' {
+		return 0, ErrIncompletePID
+	}
+	pid, err := strconv.Atoi(string(bytes.TrimSpace(record)))
+	if err != nil {
+		return 0, l.pathError("parse", err)
+	}
+	return pid, nil
+}
+
+// WhoHolds returns the PID of the process holding the lock, as recorded in
+// the lock file by LockWithPID, or 0 if the lock isn't held.  Unlike
+// HolderPID, it ignores a PID left behind by an earlier holder, but it can
+// still return 0 for a holder that didn't record its PID, and the holder may
+// have let go by the time it returns.
+//
+// No platform reports which process holds a file lock, so for holders that
+// don't use LockWithPID there is nothing to go on.
+func (l *Lock) WhoHolds() (int, error) {
+	locked, err := l.IsLocked()
+	if err != nil || !locked {
+		return 0, err
+	}
+	return l.HolderPID()
+}
+
+// BreakStaleLock takes the lock if the PID recorded in the lock file by
+// LockWithPID belongs to a process that no longer exists, replacing that PID
+// with this process's, and reports whether it did.  It doesn't wait for the
+// lock, and does nothing if no PID has been recorded or its process is still
+// running, even if the lock is free.
+//
+// The system releases a file lock when its holder dies, so a dead holder's
+// lock can be taken with TryLock anyway.  BreakStaleLock is for telling such
+// a lock apart from one that was released normally, for example so that the
+// new holder can clean up after the dead one.  The check can be fooled if the
+// dead holder's PID has been reused.
+func (l *Lock) BreakStaleLock() (broken bool, err error) {
+	pid, err := l.HolderPID()
+	if err != nil || pid == 0 {
+		return false, err
+	}
+	exists, err := processExists(pid)
+	if err != nil || exists {
+		return false, err
+	}
+	if err := l.TryLock(); err != nil {
+		if err == ErrLocked {
+			// Someone else got there first, perhaps to break it too.
+			return false, nil
+		}
+		return false, err
+	}
+	if err := l.recordPID(); err != nil {
+		return false, err
+	}
+	return true, nil
+}
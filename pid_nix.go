@@ -0,0 +1,24 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package fslock
+
+import (
+	"syscall"
+)
+
+// processExists reports whether a process with the given PID exists.
+func processExists(pid int) (bool, error) {
+	switch err := syscall.Kill(pid, 0); err {
+	case nil, syscall.EPERM:
+		// EPERM means it exists, but belongs to someone else.
+		return true, nil
+	case syscall.ESRCH:
+		return false, nil
+	default:
+		return false, err
+	}
+}
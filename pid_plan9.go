@@ -0,0 +1,18 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+import (
+	"os"
+	"strconv"
+)
+
+// processExists reports whether a process with the given PID exists.
+func processExists(pid int) (bool, error) {
+	_, err := os.Stat("/proc/" + strconv.Itoa(pid))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
@@ -0,0 +1,35 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+import (
+	"golang.org/x/sys/windows"
+)
+
+// stillActive is the exit code of a process that hasn't exited.
+const stillActive = 259
+
+// processExists reports whether a process with the given PID exists.
+func processExists(pid int) (bool, error) {
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	switch err {
+	case nil:
+	case windows.ERROR_INVALID_PARAMETER:
+		// There is no process with that PID.
+		return false, nil
+	case windows.ERROR_ACCESS_DENIED:
+		// It exists, but belongs to someone else.
+		return true, nil
+	default:
+		return false, err
+	}
+	defer windows.CloseHandle(handle)
+	// A process that has exited can be opened for as long as anyone still
+	// has a handle to it.
+	var code uint32
+	if err := windows.GetExitCodeProcess(handle, &code); err != nil {
+		return false, err
+	}
+	return code == stillActive, nil
+}
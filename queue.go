@@ -0,0 +1,45 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+import (
+	"sync"
+)
+
+// Queue runs functions under a lock one at a time, in the order Do was called
+// in, for workers in one process that all need the lock in turn.  flock makes
+// no promise about which waiter gets a lock next, so workers calling Lock on
+// their own can be served in any order; a Queue lines them up first.  Only
+// callers in this process are ordered: each function takes and releases the
+// lock on its own, so other processes can get the lock in between them.
+type Queue struct {
+	lock *Lock
+
+	mu sync.Mutex
+	// tail is closed once the function queued last has finished.
+	tail chan struct{}
+}
+
+// NewQueue returns a queue that runs functions under the given lock.  The lock
+// shouldn't also be used directly while the queue is in use.
+func NewQueue(l *Lock) *Queue {
+	tail := make(chan struct{})
+	close(tail)
+	return &Queue{lock: l, tail: tail}
+}
+
+// Do waits for the functions queued before it to finish, then locks the lock,
+// blocking until it is available, runs fn and unlocks it again, returning
+// fn's error, or else any error locking or unlocking, as WithLock does.  The
+// lock is released and the queue moves on even if fn panics.
+func (q *Queue) Do(fn func() error) error {
+	done := make(chan struct{})
+	q.mu.Lock()
+	prev := q.tail
+	q.tail = done
+	q.mu.Unlock()
+	defer close(done)
+	<-prev
+	return q.lock.run(q.lock.Lock, fn)
+}
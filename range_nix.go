@@ -0,0 +1,104 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build aix || darwin || dragonfly || freebsd || linux || netbsd || openbsd || solaris
+// +build aix darwin dragonfly freebsd linux netbsd openbsd solaris
+
+package fslock
+
+import (
+	"io"
+	"syscall"
+)
+
+// LockRange locks length bytes of the lock file starting at offset, shared
+// or exclusively, blocking until the range is available.  A length of zero
+// extends the range to the end of the file, however large it grows.
+// Separate ranges can be locked by different holders at the same time.
+//
+// Range locks are POSIX record locks taken with fcntl, which behave quite
+// differently from the flock locks used by the rest of this package:
+// they belong to the process rather than to the open file, so instances in
+// the same process don't exclude each other, they are not inherited by child
+// processes, and closing any descriptor the process has for the file
+// releases all of them.  Don't mix range locks with the whole
+// file methods on the same instance; Unlock releases every range with the
+// lock file.
+func (l *Lock) LockRange(offset, length int64, exclusive bool) error {
+	return l.fcntlLock(syscall.F_SETLKW, rangeLockType(exclusive), io.SeekStart, offset, length)
+}
+
+// TryLockRange attempts to lock a range of the lock file as LockRange does.
+// This method will return ErrLocked immediately if the range cannot be
+// locked.
+func (l *Lock) TryLockRange(offset, length int64, exclusive bool) error {
+	return l.fcntlLock(syscall.F_SETLK, rangeLockType(exclusive), io.SeekStart, offset, length)
+}
+
+// UnlockRange unlocks a range of the lock file locked by LockRange or
+// TryLockRange.
+func (l *Lock) UnlockRange(offset, length int64) error {
+	if l.fd == -1 {
+		return nil
+	}
+	return l.fcntlLock(syscall.F_SETLK, syscall.F_UNLCK, io.SeekStart, offset, length)
+}
+
+// FcntlLock takes a POSIX record lock on the lock file with exactly the
+// fcntl parameters given, for working alongside programs, such as databases,
+// that lock their files that way rather than with flock.  The range starts
+// at start relative to whence, one of io.SeekStart, io.SeekCurrent or
+// io.SeekEnd, and runs for length bytes, or to the end of the file, however
+// large it grows, if length is zero.  If wait is true FcntlLock blocks with
+// F_SETLKW until the range is available; otherwise it uses F_SETLK and
+// returns ErrLocked if the range is locked by another process.
+//
+// The lock behaves like those taken by LockRange, and is released by
+// UnlockRange on the same range measured from the start of the file, or
+// with every other range by Unlock.
+func (l *Lock) FcntlLock(whence int, start, length int64, exclusive, wait bool) error {
+	cmd := syscall.F_SETLK
+	if wait {
+		cmd = syscall.F_SETLKW
+	}
+	return l.fcntlLock(cmd, rangeLockType(exclusive), whence, start, length)
+}
+
+func rangeLockType(exclusive bool) int16 {
+	if exclusive {
+		return syscall.F_WRLCK
+	}
+	return syscall.F_RDLCK
+}
+
+// fcntlLock applies a record lock of the given type to a range of the lock
+// file, measured from whence.  The file is left open on failure, since other
+// ranges may still be locked through it.
+func (l *Lock) fcntlLock(cmd int, typ int16, whence int, offset, length int64) error {
+	if typ != syscall.F_UNLCK {
+		if err := l.advisoryOnly(); err != nil {
+			return err
+		}
+	}
+	if err := l.open(); err != nil {
+		return err
+	}
+	lk := syscall.Flock_t{
+		Type:   typ,
+		Whence: int16(whence),
+		Start:  offset,
+		Len:    length,
+	}
+	err := syscall.FcntlFlock(uintptr(l.fd), cmd, &lk)
+	// As in sysLockFd, a signal mustn't make a blocking lock fail.
+	for err == syscall.EINTR {
+		err = syscall.FcntlFlock(uintptr(l.fd), cmd, &lk)
+	}
+	if typ == syscall.F_UNLCK {
+		return l.pathError("unlock range", err)
+	}
+	if cmd == syscall.F_SETLK && lockError(err) == syscall.EWOULDBLOCK {
+		return ErrLocked
+	}
+	return l.pathError("lock range", err)
+}
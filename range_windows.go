@@ -0,0 +1,93 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+import (
+	"context"
+	"math"
+
+	"golang.org/x/sys/windows"
+)
+
+// LockRange locks length bytes of the lock file starting at offset, shared
+// or exclusively, blocking until the range is available.  A length of zero
+// extends the range to the largest offset possible.  Separate ranges can be
+// locked by different holders at the same time.
+//
+// Range locks are taken with LockFileEx on the instance's handle for the lock
+// file, separately from the whole file lock, which only covers the first
+// byte.  Don't mix range locks with the whole file methods on the same
+// instance; Unlock releases every range with the lock file.
+func (l *Lock) LockRange(offset, length int64, exclusive bool) error {
+	return l.lockRange(rangeLockFlags(exclusive), offset, length)
+}
+
+// TryLockRange attempts to lock a range of the lock file as LockRange does.
+// This method will return ErrLocked immediately if the range cannot be
+// locked.
+func (l *Lock) TryLockRange(offset, length int64, exclusive bool) error {
+	err := l.lockRange(rangeLockFlags(exclusive)|windows.LOCKFILE_FAIL_IMMEDIATELY, offset, length)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return ErrLocked
+	}
+	return err
+}
+
+// UnlockRange unlocks a range of the lock file locked by LockRange or
+// TryLockRange.
+func (l *Lock) UnlockRange(offset, length int64) error {
+	if l.handle == windows.InvalidHandle {
+		return nil
+	}
+	return l.pathError("unlock range", unlockRegion(l.handle, newRegion(offset, length)))
+}
+
+// LockWithFlags locks length bytes of the lock file starting at offset by
+// calling LockFileEx with the given flags, for callers that need to choose
+// them for themselves, as when sharing a file with other software that locks
+// it.  LockFileEx supports two flags: LOCKFILE_EXCLUSIVE_LOCK for an
+// exclusive rather than shared lock, and LOCKFILE_FAIL_IMMEDIATELY to return
+// ErrLocked rather than wait if the range is locked by someone else.  Any
+// other flags are passed on for LockFileEx to reject.  The range is as for
+// LockRange, and is unlocked with UnlockRange.
+func (l *Lock) LockWithFlags(flags uint32, offset, length int64) error {
+	err := l.lockRange(flags, offset, length)
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return ErrLocked
+	}
+	return err
+}
+
+func rangeLockFlags(exclusive bool) uint32 {
+	if exclusive {
+		return windows.LOCKFILE_EXCLUSIVE_LOCK
+	}
+	return 0
+}
+
+// newRegion returns the region for a range given to LockRange.
+func newRegion(offset, length int64) region {
+	if length == 0 {
+		return region{offset: uint64(offset), length: math.MaxUint64 - uint64(offset)}
+	}
+	return region{offset: uint64(offset), length: uint64(length)}
+}
+
+// lockRange locks a range of the lock file with the given LockFileEx flags,
+// opening the file first if need be.  The file is left open on failure, since
+// other ranges may still be locked through it.
+func (l *Lock) lockRange(flags uint32, offset, length int64) error {
+	if l.handle == windows.InvalidHandle {
+		handle, err := l.openFile(windows.OPEN_ALWAYS)
+		if err != nil {
+			return l.pathError("open", err)
+		}
+		l.handle = handle
+	}
+	err := l.lockRegion(context.Background(), l.handle, flags, newRegion(offset, length))
+	if err == windows.ERROR_LOCK_VIOLATION {
+		return err
+	}
+	return l.pathError("lock range", err)
+}
@@ -0,0 +1,38 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+// Acquire takes a reference to the lock, locking it if this is the first
+// reference.  It lets several goroutines share one lock: the lock is held
+// from the first Acquire until the balancing Release, and later Acquire calls
+// return immediately.  If locking fails, no reference is taken.
+//
+// Acquire and Release keep their own count and shouldn't be mixed with the
+// other locking methods on the same instance.
+func (l *Lock) Acquire() error {
+	l.refMu.Lock()
+	defer l.refMu.Unlock()
+	if l.refs == 0 {
+		if err := l.Lock(); err != nil {
+			return err
+		}
+	}
+	l.refs++
+	return nil
+}
+
+// Release drops a reference taken by Acquire, unlocking the lock once the
+// last reference is gone.  Releasing with no references is a no-op.
+func (l *Lock) Release() error {
+	l.refMu.Lock()
+	defer l.refMu.Unlock()
+	if l.refs == 0 {
+		return nil
+	}
+	l.refs--
+	if l.refs > 0 {
+		return nil
+	}
+	return l.Unlock()
+}
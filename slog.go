@@ -0,0 +1,36 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build go1.21
+// +build go1.21
+
+package fslock
+
+import (
+	"context"
+	"log/slog"
+)
+
+// WithSlog sets a structured logger that is given an event, with the lock
+// file's path as its "path" attribute, as each attempt to acquire the lock
+// begins, at the debug level, and each time the lock is acquired, released or
+// times out, at the info level.  Those also have an "outcome" attribute, and
+// "waited" or "held" for how long the lock was waited for or held.  By
+// default, or with a nil logger, nothing is logged.  It can be used alongside
+// WithLogger, which logs more of the steps along the way as text.  It needs
+// Go 1.21.
+func WithSlog(logger *slog.Logger) Option {
+	return func(o *options) {
+		if logger == nil {
+			o.events = nil
+			return
+		}
+		o.events = func(debug bool, msg string, args ...interface{}) {
+			level := slog.LevelInfo
+			if debug {
+				level = slog.LevelDebug
+			}
+			logger.Log(context.Background(), level, msg, args...)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+//go:build go1.21
+// +build go1.21
+
+package fslock_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"path/filepath"
+	"strings"
+
+	gc "gopkg.in/check.v1"
+
+	"github.com/xianic/fslock"
+)
+
+func (s *fslockSuite) TestWithSlog(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	lock := fslock.New(path, fslock.WithSlog(logger))
+	c.Assert(lock.Lock(), gc.IsNil)
+	c.Assert(fslock.New(path, fslock.WithSlog(logger)).LockWithTimeout(shortWait), gc.Equals, fslock.ErrTimeout)
+	c.Assert(lock.Unlock(), gc.IsNil)
+
+	var got []string
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]interface{}
+		c.Assert(json.Unmarshal([]byte(line), &record), gc.IsNil)
+		c.Assert(record["path"], gc.Equals, path)
+		got = append(got, record["level"].(string)+" "+record["msg"].(string)+" "+fmtOutcome(record))
+	}
+	c.Assert(got, gc.DeepEquals, []string{
+		"DEBUG acquiring lock -",
+		"INFO lock acquired acquired",
+		"DEBUG acquiring lock -",
+		"INFO lock timed out timeout",
+		"INFO lock released released",
+	})
+}
+
+// fmtOutcome returns the outcome recorded in a log record, or "-" if none.
+func fmtOutcome(record map[string]interface{}) string {
+	if outcome, ok := record["outcome"].(string); ok {
+		return outcome
+	}
+	return "-"
+}
+
+func (s *fslockSuite) TestWithSlogTryLockWithTimeout(c *gc.C) {
+	path := filepath.Join(c.MkDir(), "testing")
+	holder := fslock.New(path)
+	c.Assert(holder.Lock(), gc.IsNil)
+	defer holder.Unlock()
+	var buf bytes.Buffer
+	logger := slog.New(slog.NewJSONHandler(&buf, nil))
+	lock := fslock.New(path, fslock.WithSlog(logger))
+	c.Assert(lock.TryLockWithTimeout(shortWait, shortWait/2), gc.Equals, fslock.ErrTimeout)
+
+	var record map[string]interface{}
+	c.Assert(json.Unmarshal(buf.Bytes(), &record), gc.IsNil)
+	c.Assert(record["msg"], gc.Equals, "lock timed out")
+	c.Assert(record["outcome"], gc.Equals, "timeout")
+}
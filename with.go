@@ -0,0 +1,47 @@
+// Copyright 2016 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package fslock
+
+import (
+	"context"
+)
+
+// WithLock locks the given lock file, blocking until it is available, runs fn
+// and unlocks it again, returning fn's error, or else any error unlocking.
+// The lock is released even if fn panics.
+func WithLock(filename string, fn func() error) error {
+	l := New(filename)
+	return l.run(l.Lock, fn)
+}
+
+// WithLockContext is like WithLock, but gives up waiting for the lock when the
+// context is done, returning the context's error, or the cause it was
+// canceled with, if any, without running fn.
+func WithLockContext(ctx context.Context, filename string, fn func() error) error {
+	l := New(filename)
+	return l.run(func() error {
+		return l.LockWithContext(ctx)
+	}, fn)
+}
+
+// TryWithLock is like WithLock, but returns ErrLocked without running fn if
+// the lock is held by someone else.
+func TryWithLock(filename string, fn func() error) error {
+	l := New(filename)
+	return l.run(l.TryLock, fn)
+}
+
+// run locks the lock with lock, then runs fn and unlocks it, however fn
+// returns.
+func (l *Lock) run(lock func() error, fn func() error) (err error) {
+	if err := lock(); err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := l.Unlock(); err == nil {
+			err = uerr
+		}
+	}()
+	return fn()
+}